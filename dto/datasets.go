@@ -0,0 +1,131 @@
+package dto
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DatasetHttpRequests       = "http_requests"
+	DatasetFirewallEvents     = "firewall_events"
+	DatasetDnsLogs            = "dns_logs"
+	DatasetSpectrumEvents     = "spectrum_events"
+	DatasetWorkersTraceEvents = "workers_trace_events"
+)
+
+// LogTimestamp 兼容 Logpush 的 rfc3339 / unix / unixnano 时间格式
+type LogTimestamp struct {
+	time.Time
+}
+
+func (t *LogTimestamp) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch {
+		case v > 1e17:
+			t.Time = time.Unix(0, v)
+		case v > 1e14:
+			t.Time = time.UnixMicro(v)
+		case v > 1e11:
+			t.Time = time.UnixMilli(v)
+		default:
+			t.Time = time.Unix(v, 0)
+		}
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+func (t LogTimestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+}
+
+type FirewallEvent struct {
+	Action                 string       `json:"Action"`
+	ClientASN              int          `json:"ClientASN"`
+	ClientASNDescription   string       `json:"ClientASNDescription"`
+	ClientCountry          string       `json:"ClientCountry"`
+	ClientIP               string       `json:"ClientIP"`
+	ClientIPClass          string       `json:"ClientIPClass"`
+	ClientRefererHost      string       `json:"ClientRefererHost"`
+	ClientRequestHost      string       `json:"ClientRequestHost"`
+	ClientRequestMethod    string       `json:"ClientRequestMethod"`
+	ClientRequestPath      string       `json:"ClientRequestPath"`
+	ClientRequestProtocol  string       `json:"ClientRequestProtocol"`
+	ClientRequestQuery     string       `json:"ClientRequestQuery"`
+	ClientRequestScheme    string       `json:"ClientRequestScheme"`
+	ClientRequestUserAgent string       `json:"ClientRequestUserAgent"`
+	Datetime               LogTimestamp `json:"Datetime"`
+	Description            string       `json:"Description"`
+	EdgeColoCode           string       `json:"EdgeColoCode"`
+	EdgeResponseStatus     int          `json:"EdgeResponseStatus"`
+	Kind                   string       `json:"Kind"`
+	MatchIndex             int          `json:"MatchIndex"`
+	OriginResponseStatus   int          `json:"OriginResponseStatus"`
+	OriginatorRayID        string       `json:"OriginatorRayID"`
+	RayID                  string       `json:"RayID"`
+	RuleID                 string       `json:"RuleID"`
+	Source                 string       `json:"Source"`
+}
+
+type DnsLog struct {
+	ColoCode         string       `json:"ColoCode"`
+	EDNSSubnet       string       `json:"EDNSSubnet"`
+	EDNSSubnetLength int          `json:"EDNSSubnetLength"`
+	QueryName        string       `json:"QueryName"`
+	QueryType        int          `json:"QueryType"`
+	ResponseCached   bool         `json:"ResponseCached"`
+	ResponseCode     int          `json:"ResponseCode"`
+	SourceIP         string       `json:"SourceIP"`
+	Timestamp        LogTimestamp `json:"Timestamp"`
+}
+
+type SpectrumEvent struct {
+	Application         string       `json:"Application"`
+	ClientAsn           int          `json:"ClientAsn"`
+	ClientBytes         int64        `json:"ClientBytes"`
+	ClientCountry       string       `json:"ClientCountry"`
+	ClientIP            string       `json:"ClientIP"`
+	ClientPort          int          `json:"ClientPort"`
+	ClientProto         string       `json:"ClientProto"`
+	ClientTcpRtt        int64        `json:"ClientTcpRtt"`
+	ClientTlsProtocol   string       `json:"ClientTlsProtocol"`
+	ClientTlsStatus     string       `json:"ClientTlsStatus"`
+	ColoCode            string       `json:"ColoCode"`
+	ConnectTimestamp    LogTimestamp `json:"ConnectTimestamp"`
+	DisconnectTimestamp LogTimestamp `json:"DisconnectTimestamp"`
+	Event               string       `json:"Event"`
+	OriginBytes         int64        `json:"OriginBytes"`
+	OriginIP            string       `json:"OriginIP"`
+	OriginPort          int          `json:"OriginPort"`
+	OriginProto         string       `json:"OriginProto"`
+	OriginTcpRtt        int64        `json:"OriginTcpRtt"`
+	Status              int          `json:"Status"`
+	Timestamp           LogTimestamp `json:"Timestamp"`
+}
+
+type WorkersTraceEvent struct {
+	DispatchNamespace string            `json:"DispatchNamespace"`
+	Event             json.RawMessage   `json:"Event"`
+	EventTimestampMs  int64             `json:"EventTimestampMs"`
+	EventType         string            `json:"EventType"`
+	Exceptions        []json.RawMessage `json:"Exceptions"`
+	Logs              []json.RawMessage `json:"Logs"`
+	Outcome           string            `json:"Outcome"`
+	ScriptName        string            `json:"ScriptName"`
+	ScriptTags        []string          `json:"ScriptTags"`
+	ScriptVersion     json.RawMessage   `json:"ScriptVersion"`
+}
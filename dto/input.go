@@ -51,6 +51,8 @@ type OutputLog struct {
 	Country       string `json:"country"`
 	Region        string `json:"region"`
 	Domain        string `json:"domain"`
+	Zone          string `json:"zone,omitempty"`
+	ZoneName      string `json:"zone_name,omitempty"`
 	BW            int    `json:"bw"`
 	Flux          int    `json:"flux"`
 	BSBW          int    `json:"bs_bw"`
@@ -68,6 +70,7 @@ type OutputLog struct {
 	BSHTTPCode3XX int    `json:"bs_http_code_3xx"`
 	BSHTTPCode4XX int    `json:"bs_http_code_4xx"`
 	BSHTTPCode5XX int    `json:"bs_http_code_5xx"`
+	BSDurationMs  int    `json:"bs_duration_ms,omitempty"`
 
 	TenantId  string `json:"tenantId"`
 	TimeLocal int64  `json:"time_local"`
@@ -100,9 +103,11 @@ type OutputStatisticalData struct {
 	BSHTTPCode3XX int    `json:"b3xx"`
 	BSHTTPCode4XX int    `json:"b4xx"`
 	BSHTTPCode5XX int    `json:"b5xx"`
+	BSDurationMs  int    `json:"bs_duration_ms,omitempty"`
 
 	TenantId  string `json:"t"`
 	TimeLocal int64  `json:"time_local"`
+	Interval  int64  `json:"interval"`
 }
 
 type OutputLogBillDate struct {
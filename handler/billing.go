@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	billingPageSize = 1000
+	billingAllKey   = "*"
+)
+
+// billingSample 同一域名、同一分钟、同一粒度的所有上报的 bw/flux 之和, Interval 为 0 时按 60 秒处理
+type billingSample struct {
+	Time     int64
+	Interval int64
+	BW       int64
+	Flux     int64
+}
+
+// billingPoint 计费周期 (默认 5 分钟) 内的峰值带宽与流量, Filled 表示该周期没有数据, 补 0
+type billingPoint struct {
+	Time   int64
+	Peak   int64
+	Flux   int64
+	Filled bool
+}
+
+type billingResult struct {
+	TenantId  string `json:"tenantId"`
+	Domain    string `json:"domain"`
+	Month     string `json:"month"`
+	P95BW     int64  `json:"p95Bw"`
+	AvgPeakBW int64  `json:"avgPeakBw"`
+	PeakBW    int64  `json:"peakBw"`
+	TotalFlux int64  `json:"totalFlux"`
+	Intervals int    `json:"intervals"`
+	Missing   int    `json:"missing"`
+}
+
+// billingInterval 计费周期秒数, BILLING_INTERVAL_SEC 默认 300
+func billingInterval() int64 {
+	return int64(envInt("BILLING_INTERVAL_SEC", 300))
+}
+
+// billingLocation 账单按自然月/自然日切分的时区, BILLING_TZ_OFFSET 为相对 UTC 的小时数, 默认东八区
+func billingLocation() *time.Location {
+	offset := envInt("BILLING_TZ_OFFSET", 8)
+	return time.FixedZone(fmt.Sprintf("UTC%+d", offset), offset*3600)
+}
+
+// billingMonthRange month 格式 2006-01, 当月未结束时截止到 now 所在计费周期的起点
+func billingMonthRange(month string, now time.Time, interval int64) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, billingLocation())
+	if err != nil {
+		return start, start, fmt.Errorf("month 格式应为 2006-01")
+	}
+	end := start.AddDate(0, 1, 0)
+	if cutoff := time.Unix(now.Unix()-now.Unix()%interval, 0); cutoff.Before(end) {
+		end = cutoff
+	}
+	if !end.After(start) {
+		return start, end, fmt.Errorf("账单月份 %s 尚未开始", month)
+	}
+	return start, end, nil
+}
+
+// buildPeakSeries 把样本展开到其粒度覆盖的每一分钟 (5 分钟粒度的 bw 在 5 个分钟上都计入) 后按分钟求和,
+// 再按计费周期取峰值, [start, end) 内没有样本的周期补 0
+func buildPeakSeries(samples []billingSample, start, end time.Time, interval int64) []billingPoint {
+	from, to := start.Unix(), end.Unix()
+	n := int((to - from + interval - 1) / interval)
+	if n <= 0 {
+		return nil
+	}
+	points := make([]billingPoint, n)
+	for i := range points {
+		points[i] = billingPoint{Time: from + int64(i)*interval, Filled: true}
+	}
+	minutes := make(map[int64]int64)
+	for _, s := range samples {
+		if s.Time >= from && s.Time < to {
+			p := &points[(s.Time-from)/interval]
+			p.Filled = false
+			p.Flux += s.Flux
+		}
+		span := s.Interval
+		if span <= 0 {
+			span = clientPushInterval
+		}
+		for offset := int64(0); offset < span; offset += 60 {
+			minutes[s.Time+offset] += s.BW
+		}
+	}
+	for ts, bw := range minutes {
+		if ts < from || ts >= to {
+			continue
+		}
+		p := &points[(ts-from)/interval]
+		p.Filled = false
+		if bw > p.Peak {
+			p.Peak = bw
+		}
+	}
+	return points
+}
+
+// computeBilling P95: 周期峰值升序排列后取第 ceil(n*0.95) 个; 月平均日峰值: 每个自然日峰值的平均; 总流量: flux 之和
+func computeBilling(points []billingPoint, loc *time.Location) billingResult {
+	var result billingResult
+	if len(points) == 0 {
+		return result
+	}
+	peaks := make([]int64, len(points))
+	dailyPeak := make(map[string]int64)
+	for i, p := range points {
+		peaks[i] = p.Peak
+		result.TotalFlux += p.Flux
+		if p.Filled {
+			result.Missing++
+		}
+		if p.Peak > result.PeakBW {
+			result.PeakBW = p.Peak
+		}
+		day := time.Unix(p.Time, 0).In(loc).Format("2006-01-02")
+		if peak, ok := dailyPeak[day]; !ok || p.Peak > peak {
+			dailyPeak[day] = p.Peak
+		}
+	}
+	sort.Slice(peaks, func(i, j int) bool { return peaks[i] < peaks[j] })
+	result.P95BW = peaks[int(math.Ceil(float64(len(peaks))*0.95))-1]
+	var daySum int64
+	for _, peak := range dailyPeak {
+		daySum += peak
+	}
+	result.AvgPeakBW = daySum / int64(len(dailyPeak))
+	result.Intervals = len(points)
+	return result
+}
+
+// fetchBillingSamples 用 composite 聚合按 (域名, 分钟, 粒度) 分页拉取 bw/flux 之和, 旧数据没有 interval 字段
+func fetchBillingSamples(ctx context.Context, tenantId, domain string, start, end time.Time) (map[string][]billingSample, error) {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("t", tenantId),
+		elastic.NewRangeQuery("start_time").Gte(start.Unix()).Lt(end.Unix()).Format("epoch_second"),
+	)
+	if domain != "" {
+		query = query.Filter(elastic.NewTermQuery("d", domain))
+	}
+	samples := make(map[string][]billingSample)
+	var after map[string]interface{}
+	for {
+		agg := elastic.NewCompositeAggregation().Size(billingPageSize).Sources(
+			elastic.NewCompositeAggregationTermsValuesSource("d").Field("d"),
+			elastic.NewCompositeAggregationDateHistogramValuesSource("ts").Field("start_time").FixedInterval("1m"),
+			elastic.NewCompositeAggregationTermsValuesSource("iv").Field("interval").MissingBucket(true),
+		).SubAggregation("bw", elastic.NewSumAggregation().Field("bw")).
+			SubAggregation("flux", elastic.NewSumAggregation().Field("flux"))
+		if after != nil {
+			agg = agg.AggregateAfter(after)
+		}
+		res, err := esClient.Search(esBillingPrefix).IgnoreUnavailable(true).Query(query).Size(0).Aggregation("samples", agg).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		page, ok := res.Aggregations.Composite("samples")
+		if !ok || len(page.Buckets) == 0 {
+			return samples, nil
+		}
+		for _, bucket := range page.Buckets {
+			d := fmt.Sprint(bucket.Key["d"])
+			ts, _ := bucket.Key["ts"].(float64)
+			iv, _ := bucket.Key["iv"].(float64)
+			samples[d] = append(samples[d], billingSample{
+				Time:     int64(ts) / 1000,
+				Interval: int64(iv),
+				BW:       sumValue(bucket.Aggregations, "bw"),
+				Flux:     sumValue(bucket.Aggregations, "flux"),
+			})
+		}
+		if page.AfterKey == nil {
+			return samples, nil
+		}
+		after = page.AfterKey
+	}
+}
+
+func sumValue(aggs elastic.Aggregations, name string) int64 {
+	sum, ok := aggs.Sum(name)
+	if !ok || sum.Value == nil {
+		return 0
+	}
+	return int64(*sum.Value)
+}
+
+// computeMonthBilling 返回租户汇总 (domain 为 *) 和各域名的账单, 域名按字母序
+func computeMonthBilling(ctx context.Context, tenantId, domain, month string, now time.Time) ([]billingResult, error) {
+	interval := billingInterval()
+	start, end, err := billingMonthRange(month, now, interval)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := fetchBillingSamples(ctx, tenantId, domain, start, end)
+	if err != nil {
+		return nil, err
+	}
+	domains := make([]string, 0, len(samples))
+	for d := range samples {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	loc := billingLocation()
+	results := make([]billingResult, 0, len(domains)+1)
+	var all []billingSample
+	for _, d := range domains {
+		all = append(all, samples[d]...)
+		result := computeBilling(buildPeakSeries(samples[d], start, end, interval), loc)
+		result.TenantId, result.Domain, result.Month = tenantId, d, month
+		results = append(results, result)
+	}
+	// 租户汇总按分钟把所有域名的带宽相加后再取周期峰值, 各域名峰值不在同一分钟时不能直接相加
+	result := computeBilling(buildPeakSeries(all, start, end, interval), loc)
+	result.TenantId, result.Domain, result.Month = tenantId, billingAllKey, month
+	return append([]billingResult{result}, results...), nil
+}
+
+func writeBillingCSV(w http.ResponseWriter, filename string, results []billingResult) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"tenant_id", "domain", "month", "p95_bw", "avg_peak_bw", "peak_bw", "total_flux", "intervals", "missing"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.TenantId, r.Domain, r.Month,
+			strconv.FormatInt(r.P95BW, 10),
+			strconv.FormatInt(r.AvgPeakBW, 10),
+			strconv.FormatInt(r.PeakBW, 10),
+			strconv.FormatInt(r.TotalFlux, 10),
+			strconv.Itoa(r.Intervals),
+			strconv.Itoa(r.Missing),
+		})
+	}
+	cw.Flush()
+}
+
+// HandleBilling GET /v2/billing?month=2006-01&domain=&tenantId=&format=json|csv
+// 第一行为租户汇总 (domain 为 *), 之后为各域名; 与查询接口使用同一套 QUERY_TOKENS 鉴权
+func HandleBilling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅支持 GET 方法", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, code, err := queryTenant(r)
+	if err != nil {
+		writeJobResponse(w, code, err.Error())
+		return
+	}
+	if esClient == nil {
+		writeJobResponse(w, http.StatusServiceUnavailable, "ES 客户端未初始化")
+		return
+	}
+	q := r.URL.Query()
+	month := q.Get("month")
+	if _, _, err := billingMonthRange(month, time.Now(), billingInterval()); err != nil {
+		writeJobResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	results, err := computeMonthBilling(ctx, tenant, q.Get("domain"), month, time.Now())
+	if err != nil {
+		writeJobResponse(w, http.StatusInternalServerError, "计算账单失败: "+err.Error())
+		return
+	}
+	if q.Get("format") == "csv" {
+		writeBillingCSV(w, fmt.Sprintf("billing-%s-%s.csv", tenant, month), results)
+		return
+	}
+	writeJobResponse(w, http.StatusOK, map[string]interface{}{
+		"tenantId": tenant,
+		"month":    month,
+		"interval": billingInterval(),
+		"billing":  results,
+	})
+}
@@ -0,0 +1,387 @@
+package handler
+
+import (
+	"bytes"
+	"cf_logpush/dto"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	reportFileMode  = 0444
+	reportMaxGroups = 10000
+)
+
+var reportSchedulerOnce sync.Once
+
+// regionUsage 地区维度来自统计索引 (账单索引没有地区字段)
+type regionUsage struct {
+	Region    string  `json:"region"`
+	Flux      int64   `json:"flux"`
+	ReqNum    int64   `json:"reqNum"`
+	FluxShare float64 `json:"fluxShare"`
+}
+
+// billingReport 月度账单快照, 生成后只读, 更正时生成新的 Revision
+type billingReport struct {
+	TenantId    string          `json:"tenantId"`
+	Month       string          `json:"month"`
+	Revision    int             `json:"revision"`
+	Reason      string          `json:"reason,omitempty"`
+	GeneratedAt string          `json:"generatedAt"`
+	Interval    int64           `json:"interval"`
+	Summary     billingResult   `json:"summary"`
+	Domains     []billingResult `json:"domains"`
+	Regions     []regionUsage   `json:"regions"`
+}
+
+// reportDir REPORT_DIR 默认 LogPath/billing_reports, 目录结构 <month>/<tenant>/r<N>.json|csv
+func reportDir() string {
+	if dir := os.Getenv("REPORT_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(dto.LogPath, "billing_reports")
+}
+
+func reportTenantDir(month, tenantId string) (string, error) {
+	name := url.PathEscape(tenantId)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("非法的 tenantId: %q", tenantId)
+	}
+	return filepath.Join(reportDir(), month, name), nil
+}
+
+// latestReportRevision 返回已有的最大版本号, 没有快照时为 0
+func latestReportRevision(month, tenantId string) (int, error) {
+	dir, err := reportTenantDir(month, tenantId)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	latest := 0
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "r") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "r"), ".json")); err == nil && n > latest {
+			latest = n
+		}
+	}
+	return latest, nil
+}
+
+// reportTenants 账单索引中该月有数据的租户
+func reportTenants(ctx context.Context, start, end time.Time) ([]string, error) {
+	query := elastic.NewRangeQuery("start_time").Gte(start.Unix()).Lt(end.Unix()).Format("epoch_second")
+	res, err := esClient.Search(esBillingPrefix).IgnoreUnavailable(true).Query(query).Size(0).
+		Aggregation("tenants", elastic.NewTermsAggregation().Field("t").Size(reportMaxGroups)).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []string
+	if terms, ok := res.Aggregations.Terms("tenants"); ok {
+		for _, bucket := range terms.Buckets {
+			tenants = append(tenants, fmt.Sprint(bucket.Key))
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+func fetchRegionUsage(ctx context.Context, tenantId string, start, end time.Time) ([]regionUsage, error) {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("t", tenantId),
+		elastic.NewRangeQuery("start_time").Gte(start.Unix()).Lt(end.Unix()).Format("epoch_second"),
+	)
+	terms := elastic.NewTermsAggregation().Field("r").Size(reportMaxGroups).
+		SubAggregation("flux", elastic.NewSumAggregation().Field("flux")).
+		SubAggregation("req_num", elastic.NewSumAggregation().Field("req_num"))
+	res, err := esClient.Search(esStatisticalPrefix).IgnoreUnavailable(true).Query(query).Size(0).Aggregation("regions", terms).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	regions := []regionUsage{}
+	result, ok := res.Aggregations.Terms("regions")
+	if !ok {
+		return regions, nil
+	}
+	var total int64
+	for _, bucket := range result.Buckets {
+		usage := regionUsage{
+			Region: fmt.Sprint(bucket.Key),
+			Flux:   sumValue(bucket.Aggregations, "flux"),
+			ReqNum: sumValue(bucket.Aggregations, "req_num"),
+		}
+		total += usage.Flux
+		regions = append(regions, usage)
+	}
+	for i := range regions {
+		if total > 0 {
+			regions[i].FluxShare = float64(regions[i].Flux) / float64(total)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Region < regions[j].Region })
+	return regions, nil
+}
+
+// buildBillingReport 只对已结束的月份出账
+func buildBillingReport(ctx context.Context, tenantId, month string, now time.Time) (*billingReport, error) {
+	interval := billingInterval()
+	start, end, err := billingMonthRange(month, now, interval)
+	if err != nil {
+		return nil, err
+	}
+	if !end.Equal(start.AddDate(0, 1, 0)) {
+		return nil, fmt.Errorf("账单月份 %s 尚未结束", month)
+	}
+	results, err := computeMonthBilling(ctx, tenantId, "", month, now)
+	if err != nil {
+		return nil, err
+	}
+	regions, err := fetchRegionUsage(ctx, tenantId, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &billingReport{
+		TenantId:    tenantId,
+		Month:       month,
+		GeneratedAt: now.In(billingLocation()).Format(time.RFC3339),
+		Interval:    interval,
+		Summary:     results[0],
+		Domains:     results[1:],
+		Regions:     regions,
+	}, nil
+}
+
+func (r *billingReport) csv() []byte {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"tenant_id", "month", "revision", "type", "key", "total_flux", "peak_bw", "p95_bw", "avg_peak_bw", "req_num", "flux_share"})
+	head := []string{r.TenantId, r.Month, strconv.Itoa(r.Revision)}
+	for _, b := range append([]billingResult{r.Summary}, r.Domains...) {
+		typ := "domain"
+		if b.Domain == billingAllKey {
+			typ = "tenant"
+		}
+		cw.Write(append(head, typ, b.Domain,
+			strconv.FormatInt(b.TotalFlux, 10),
+			strconv.FormatInt(b.PeakBW, 10),
+			strconv.FormatInt(b.P95BW, 10),
+			strconv.FormatInt(b.AvgPeakBW, 10),
+			"", ""))
+	}
+	for _, g := range r.Regions {
+		cw.Write(append(head, "region", g.Region,
+			strconv.FormatInt(g.Flux, 10),
+			"", "", "",
+			strconv.FormatInt(g.ReqNum, 10),
+			strconv.FormatFloat(g.FluxShare, 'f', 4, 64)))
+	}
+	cw.Flush()
+	return buf.Bytes()
+}
+
+// writeReportFile 先写临时文件再 link 到目标路径, 目标已存在时失败, 保证快照不会被覆盖
+func writeReportFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := os.WriteFile(tmp, data, reportFileMode); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Link(tmp, path)
+}
+
+// saveBillingReport 以下一个版本号写入 JSON 和 CSV 快照
+func saveBillingReport(report *billingReport) error {
+	dir, err := reportTenantDir(report.Month, report.TenantId)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	latest, err := latestReportRevision(report.Month, report.TenantId)
+	if err != nil {
+		return err
+	}
+	report.Revision = latest + 1
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("r%d", report.Revision)
+	// CSV 先写, JSON 决定版本是否存在; 同版本号的 CSV 只可能是上次写 JSON 失败留下的
+	csvPath := filepath.Join(dir, name+".csv")
+	os.Remove(csvPath)
+	if err := writeReportFile(csvPath, report.csv()); err != nil {
+		return err
+	}
+	return writeReportFile(filepath.Join(dir, name+".json"), data)
+}
+
+// generateBillingReports tenantId 为空时处理该月所有租户; regenerate 为 false 时跳过已有快照的租户
+func generateBillingReports(ctx context.Context, month, tenantId string, regenerate bool, reason string, now time.Time) error {
+	tenants := []string{tenantId}
+	if tenantId == "" {
+		start, end, err := billingMonthRange(month, now, billingInterval())
+		if err != nil {
+			return err
+		}
+		if tenants, err = reportTenants(ctx, start, end); err != nil {
+			return err
+		}
+	}
+	var failed []string
+	for _, tenant := range tenants {
+		latest, err := latestReportRevision(month, tenant)
+		if err != nil {
+			failed = append(failed, tenant)
+			log.Printf("### billing-report ### [tenant: %s] [month: %s] 读取快照失败: %v\n", tenant, month, err)
+			continue
+		}
+		if latest > 0 && !regenerate {
+			continue
+		}
+		report, err := buildBillingReport(ctx, tenant, month, now)
+		if err == nil {
+			report.Reason = reason
+			err = saveBillingReport(report)
+		}
+		if err != nil {
+			failed = append(failed, tenant)
+			log.Printf("### billing-report ### [tenant: %s] [month: %s] 生成账单失败: %v\n", tenant, month, err)
+			continue
+		}
+		log.Printf("### billing-report ### [tenant: %s] [month: %s] [revision: %d] 生成完成\n", tenant, month, report.Revision)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d 个租户生成失败: %s", len(failed), strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// StartReportScheduler 每月结束 REPORT_DELAY_HOURS (默认 24) 小时后为上月补齐账单快照, REPORT_SCHEDULE=0 时关闭
+func StartReportScheduler() {
+	reportSchedulerOnce.Do(func() {
+		if os.Getenv("REPORT_SCHEDULE") == "0" || esClient == nil {
+			return
+		}
+		delay := time.Duration(envInt("REPORT_DELAY_HOURS", 24)) * time.Hour
+		check := envMinutes("REPORT_CHECK_MIN", 60)
+		go func() {
+			ticker := time.NewTicker(check)
+			defer ticker.Stop()
+			for {
+				now := time.Now()
+				thisMonth := now.In(billingLocation())
+				thisMonth = time.Date(thisMonth.Year(), thisMonth.Month(), 1, 0, 0, 0, 0, billingLocation())
+				if now.Sub(thisMonth) >= delay {
+					month := thisMonth.AddDate(0, -1, 0).Format("2006-01")
+					ctx, cancel := context.WithTimeout(context.Background(), check)
+					if err := generateBillingReports(ctx, month, "", false, "", now); err != nil {
+						log.Printf("### billing-report ### [month: %s] %v\n", month, err)
+					}
+					cancel()
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// RunBillingReport 手动出账或更正
+//
+//	cf_logpush billing-report -month 2024-01 [-tenant xxx] [-regenerate -reason "补推数据"]
+//
+// 不带 -regenerate 时只为没有快照的租户生成; -regenerate 时生成新版本, 旧版本保留
+func RunBillingReport(args []string) error {
+	fs := flag.NewFlagSet("billing-report", flag.ContinueOnError)
+	month := fs.String("month", "", "账单月份, 格式 2006-01")
+	tenant := fs.String("tenant", "", "租户, 为空时处理该月所有租户")
+	regenerate := fs.Bool("regenerate", false, "已有快照时生成新版本")
+	reason := fs.String("reason", "", "更正原因, 记录在快照中")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *month == "" {
+		return fmt.Errorf("缺少参数 -month")
+	}
+	if *regenerate && *reason == "" {
+		return fmt.Errorf("-regenerate 需要同时指定 -reason")
+	}
+	if esClient == nil {
+		return fmt.Errorf("ES 客户端未初始化")
+	}
+	return generateBillingReports(context.Background(), *month, *tenant, *regenerate, *reason, time.Now())
+}
+
+// HandleBillingReport GET /v2/billing/report?month=2006-01&revision=&format=json|csv&tenantId=
+// 返回已生成的快照, revision 为空时返回最新版本
+func HandleBillingReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅支持 GET 方法", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, code, err := queryTenant(r)
+	if err != nil {
+		writeJobResponse(w, code, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	month := q.Get("month")
+	if _, err := time.Parse("2006-01", month); err != nil {
+		writeJobResponse(w, http.StatusBadRequest, "month 格式应为 2006-01")
+		return
+	}
+	revision, _ := strconv.Atoi(q.Get("revision"))
+	if revision <= 0 {
+		if revision, err = latestReportRevision(month, tenant); err != nil {
+			writeJobResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	dir, err := reportTenantDir(month, tenant)
+	if err != nil || revision == 0 {
+		writeJobResponse(w, http.StatusNotFound, "账单尚未生成")
+		return
+	}
+	ext := ".json"
+	if q.Get("format") == "csv" {
+		ext = ".csv"
+	}
+	data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("r%d%s", revision, ext)))
+	if err != nil {
+		writeJobResponse(w, http.StatusNotFound, "账单尚未生成")
+		return
+	}
+	if ext == ".csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("report-%s-%s-r%d.csv", tenant, month, revision)))
+		w.Write(data)
+		return
+	}
+	writeJobResponse(w, http.StatusOK, json.RawMessage(data))
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+var billingTestLoc = time.FixedZone("UTC+8", 8*3600)
+
+func TestBillingMonthRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		month     string
+		now       time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "已结束的月份",
+			month:     "2024-01",
+			now:       time.Date(2024, 3, 1, 0, 0, 0, 0, billingTestLoc),
+			wantStart: time.Date(2024, 1, 1, 0, 0, 0, 0, billingTestLoc),
+			wantEnd:   time.Date(2024, 2, 1, 0, 0, 0, 0, billingTestLoc),
+		},
+		{
+			name:      "月份按东八区切分",
+			month:     "2024-01",
+			now:       time.Date(2024, 1, 31, 16, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 1, 1, 0, 0, 0, 0, billingTestLoc),
+			wantEnd:   time.Date(2024, 2, 1, 0, 0, 0, 0, billingTestLoc),
+		},
+		{
+			name:      "未结束的月份截止到当前计费周期起点",
+			month:     "2024-02",
+			now:       time.Date(2024, 2, 10, 0, 7, 30, 0, billingTestLoc),
+			wantStart: time.Date(2024, 2, 1, 0, 0, 0, 0, billingTestLoc),
+			wantEnd:   time.Date(2024, 2, 10, 0, 5, 0, 0, billingTestLoc),
+		},
+		{
+			name:    "尚未开始的月份",
+			month:   "2024-03",
+			now:     time.Date(2024, 2, 29, 23, 59, 0, 0, billingTestLoc),
+			wantErr: true,
+		},
+		{
+			name:    "格式错误",
+			month:   "2024/01",
+			now:     time.Date(2024, 3, 1, 0, 0, 0, 0, billingTestLoc),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := billingMonthRange(tt.month, tt.now, 300)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("期望错误, 得到 [%v, %v)", start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Fatalf("得到 [%v, %v), 期望 [%v, %v)", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestBuildPeakSeries(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, billingTestLoc)
+	end := start.Add(10 * time.Minute)
+	m := func(minute int64) int64 { return start.Unix() + minute*60 }
+	tests := []struct {
+		name       string
+		samples    []billingSample
+		wantPeak   []int64
+		wantFlux   []int64
+		wantFilled []bool
+	}{
+		{
+			name:       "没有数据的周期补 0",
+			samples:    nil,
+			wantPeak:   []int64{0, 0},
+			wantFlux:   []int64{0, 0},
+			wantFilled: []bool{true, true},
+		},
+		{
+			name: "周期内取分钟峰值",
+			samples: []billingSample{
+				{Time: m(0), BW: 100, Flux: 1},
+				{Time: m(3), BW: 400, Flux: 2},
+			},
+			wantPeak:   []int64{400, 0},
+			wantFlux:   []int64{3, 0},
+			wantFilled: []bool{false, true},
+		},
+		{
+			name: "不同域名同一分钟相加",
+			samples: []billingSample{
+				{Time: m(0), BW: 100},
+				{Time: m(0), BW: 80},
+			},
+			wantPeak:   []int64{180, 0},
+			wantFlux:   []int64{0, 0},
+			wantFilled: []bool{false, true},
+		},
+		{
+			name: "不同域名峰值不在同一分钟时不相加",
+			samples: []billingSample{
+				{Time: m(0), BW: 100},
+				{Time: m(1), BW: 80},
+			},
+			wantPeak:   []int64{100, 0},
+			wantFlux:   []int64{0, 0},
+			wantFilled: []bool{false, true},
+		},
+		{
+			name: "60 秒与 300 秒粒度混合",
+			samples: []billingSample{
+				{Time: m(0), Interval: 60, BW: 100, Flux: 1},
+				{Time: m(1), Interval: 60, BW: 100, Flux: 1},
+				{Time: m(2), Interval: 60, BW: 100, Flux: 1},
+				{Time: m(3), Interval: 60, BW: 100, Flux: 1},
+				{Time: m(4), Interval: 60, BW: 100, Flux: 1},
+				{Time: m(0), Interval: 300, BW: 50, Flux: 7},
+				{Time: m(5), Interval: 300, BW: 30, Flux: 4},
+				{Time: m(7), Interval: 60, BW: 20, Flux: 1},
+			},
+			wantPeak:   []int64{150, 50},
+			wantFlux:   []int64{12, 5},
+			wantFilled: []bool{false, false},
+		},
+		{
+			name: "范围外的样本忽略",
+			samples: []billingSample{
+				{Time: m(-1), BW: 900, Flux: 9},
+				{Time: m(10), BW: 900, Flux: 9},
+			},
+			wantPeak:   []int64{0, 0},
+			wantFlux:   []int64{0, 0},
+			wantFilled: []bool{true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points := buildPeakSeries(tt.samples, start, end, 300)
+			if len(points) != len(tt.wantPeak) {
+				t.Fatalf("周期数 %d, 期望 %d", len(points), len(tt.wantPeak))
+			}
+			for i, p := range points {
+				if p.Time != start.Unix()+int64(i)*300 {
+					t.Fatalf("周期 %d 起点 %d", i, p.Time)
+				}
+				if p.Peak != tt.wantPeak[i] || p.Flux != tt.wantFlux[i] || p.Filled != tt.wantFilled[i] {
+					t.Fatalf("周期 %d 得到 %+v, 期望 peak=%d flux=%d filled=%v", i, p, tt.wantPeak[i], tt.wantFlux[i], tt.wantFilled[i])
+				}
+			}
+		})
+	}
+}
+
+func TestComputeBilling(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, billingTestLoc).Unix()
+	// series 返回 n 个周期, 峰值依次为 1..n
+	series := func(n int) []billingPoint {
+		points := make([]billingPoint, n)
+		for i := range points {
+			points[i] = billingPoint{Time: base + int64(i)*300, Peak: int64(i + 1), Flux: 10}
+		}
+		return points
+	}
+	tests := []struct {
+		name   string
+		points []billingPoint
+		want   billingResult
+	}{
+		{
+			name:   "空序列",
+			points: nil,
+			want:   billingResult{},
+		},
+		{
+			name:   "P95 取第 ceil(n*0.95) 个: 20 个点取第 19 个",
+			points: series(20),
+			want:   billingResult{P95BW: 19, AvgPeakBW: 20, PeakBW: 20, TotalFlux: 200, Intervals: 20},
+		},
+		{
+			name:   "P95 取第 ceil(n*0.95) 个: 21 个点取第 20 个",
+			points: series(21),
+			want:   billingResult{P95BW: 20, AvgPeakBW: 21, PeakBW: 21, TotalFlux: 210, Intervals: 21},
+		},
+		{
+			name: "补 0 的周期计入 P95 和缺失数",
+			points: []billingPoint{
+				{Time: base, Peak: 500, Flux: 5},
+				{Time: base + 300, Filled: true},
+				{Time: base + 600, Filled: true},
+			},
+			want: billingResult{P95BW: 500, AvgPeakBW: 500, PeakBW: 500, TotalFlux: 5, Intervals: 3, Missing: 2},
+		},
+		{
+			name: "按东八区切分自然日",
+			points: []billingPoint{
+				// UTC 2023-12-31 15:55 为东八区 12-31 23:55, UTC 16:00 为东八区 01-01 00:00
+				{Time: time.Date(2023, 12, 31, 15, 55, 0, 0, time.UTC).Unix(), Peak: 100},
+				{Time: time.Date(2023, 12, 31, 16, 0, 0, 0, time.UTC).Unix(), Peak: 300},
+			},
+			want: billingResult{P95BW: 300, AvgPeakBW: 200, PeakBW: 300, Intervals: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := computeBilling(tt.points, billingTestLoc); got != tt.want {
+				t.Fatalf("得到 %+v, 期望 %+v", got, tt.want)
+			}
+		})
+	}
+}
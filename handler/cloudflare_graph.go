@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,35 +13,47 @@ import (
 var (
 	cfKey = "Bearer JXuzJ0Q65bE_boN_Y5296VliYzQGH04h50jwf-2K"
 	cfUrl = "https://api.cloudflare.com/client/v4/graphql"
+
+	cfClient = newCFGraphQLClient(cfUrl, cfKey)
+
+	cfHttpRequestsQuery = cfZoneQuery{
+		Dataset:    CFDatasetHttpRequestsAdaptiveGroups,
+		Dimensions: []string{"datetimeMinute", "clientRequestHTTPHost", "originResponseStatus", "cacheStatus", "clientCountryName", "edgeResponseStatus"},
+		Sums:       []string{"edgeResponseBytes", "originResponseDurationMs"},
+		OrderBy:    []string{"datetimeMinute_ASC"},
+		Count:      true,
+		Limit:      cfGraphQLMaxLimit,
+	}
 )
 
 type CloudFlareResponse struct {
 	Data struct {
 		Viewer struct {
-			Zones []struct {
-				HttpRequestsAdaptiveGroups []struct {
-					Count      int `json:"count"`
-					Dimensions struct {
-						CacheStatus          string `json:"cacheStatus"`
-						ClientCountryName    string `json:"clientCountryName"`
-						DatetimeMinute       string `json:"datetimeMinute"`
-						EdgeResponseStatus   int    `json:"edgeResponseStatus"`
-						OriginResponseStatus int    `json:"originResponseStatus"`
-					} `json:"dimensions"`
-					Sum struct {
-						EdgeResponseBytes int `json:"edgeResponseBytes"`
-					} `json:"sum"`
-				} `json:"httpRequestsAdaptiveGroups"`
-				ZoneTag string `json:"zoneTag"`
-			} `json:"zones"`
+			Zones []cfHttpRequestsZone `json:"zones"`
 		} `json:"viewer"`
 	} `json:"data"`
-	Errors []struct {
-		Code       string          `json:"code"`
-		Message    string          `json:"message"`
-		Path       []string        `json:"path"`
-		Extensions json.RawMessage `json:"extensions"`
-	} `json:"errors"`
+	Errors cfGraphQLErrors `json:"errors"`
+}
+
+type cfHttpRequestsZone struct {
+	HttpRequestsAdaptiveGroups []cfHttpRequestsGroup `json:"httpRequestsAdaptiveGroups"`
+	ZoneTag                    string                `json:"zoneTag"`
+}
+
+type cfHttpRequestsGroup struct {
+	Count      int `json:"count"`
+	Dimensions struct {
+		CacheStatus           string `json:"cacheStatus"`
+		ClientCountryName     string `json:"clientCountryName"`
+		ClientRequestHTTPHost string `json:"clientRequestHTTPHost"`
+		DatetimeMinute        string `json:"datetimeMinute"`
+		EdgeResponseStatus    int    `json:"edgeResponseStatus"`
+		OriginResponseStatus  int    `json:"originResponseStatus"`
+	} `json:"dimensions"`
+	Sum struct {
+		EdgeResponseBytes        int `json:"edgeResponseBytes"`
+		OriginResponseDurationMs int `json:"originResponseDurationMs"`
+	} `json:"sum"`
 }
 
 type OutputLog struct {
@@ -50,6 +61,8 @@ type OutputLog struct {
 	Country       string `json:"country"`
 	Region        string `json:"region"`
 	Domain        string `json:"domain"`
+	Zone          string `json:"zone"`
+	ZoneName      string `json:"zone_name"`
 	BW            int    `json:"bw"`
 	Flux          int    `json:"flux"`
 	BSBW          int    `json:"bs_bw"`
@@ -67,6 +80,7 @@ type OutputLog struct {
 	BSHTTPCode3XX int    `json:"bs_http_code_3xx"`
 	BSHTTPCode4XX int    `json:"bs_http_code_4xx"`
 	BSHTTPCode5XX int    `json:"bs_http_code_5xx"`
+	BSDurationMs  int    `json:"bs_duration_ms"`
 }
 
 func HandleCloudFlareOnTimeLog(w http.ResponseWriter, r *http.Request) {
@@ -113,93 +127,72 @@ func HandleCloudFlareOnTimeLog(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// queryCloudFlare 查询 [startTime, endTime) 的分组数据, 分组数达到上限时拆分时间窗口 (见 cfQueryWindow);
+// 请求失败的重试由 cfClient 负责, GraphQL 错误放在返回值的 Errors 中, 数据可能不完整
 func queryCloudFlare(zoneId, startTime, endTime string) (CloudFlareResponse, error) {
-	queryJSON := fmt.Sprintf(`{
-  "query": "{ viewer { zones(filter: {zoneTag_in: [\"%s\"]}) { zoneTag httpRequestsAdaptiveGroups(filter: {datetime_geq: \"%s\", datetime_leq: \"%s\"}, orderBy: [datetimeMinute_ASC], limit: 9999) { dimensions { datetimeMinute originResponseStatus cacheStatus clientCountryName edgeResponseStatus } sum { edgeResponseBytes } count } } }}"
-}`, zoneId, startTime, endTime)
-	//fmt.Println("queryJSON", queryJSON)
-	var (
-		err error
-	)
+	var respData CloudFlareResponse
+	start, err := time.Parse(time.RFC3339, startTime)
+	if err != nil {
+		return respData, fmt.Errorf("无效的开始时间: %s", startTime)
+	}
+	end, err := time.Parse(time.RFC3339, endTime)
+	if err != nil {
+		return respData, fmt.Errorf("无效的结束时间: %s", endTime)
+	}
+	query, err := cfHttpRequestsQuery.Build()
+	if err != nil {
+		return respData, err
+	}
 	defer func() {
 		if err != nil {
 			fmt.Println("### cloudflare-err ###", "[zoneId: "+zoneId+"] [startTime: "+startTime+"] [endTime: "+endTime+"] [resDataErr: "+err.Error()+"]")
 		}
 	}()
 
-	var (
-		respData   CloudFlareResponse
-		maxRetries = 2
-		retryCount = 0
-		retryDelay = 3 * time.Second
-	)
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		req, err := http.NewRequest("POST", cfUrl, strings.NewReader(queryJSON))
-		if err != nil {
-			return CloudFlareResponse{}, fmt.Errorf("创建请求失败: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	groups, err := cfQueryWindow(ctx, start, end, cfHttpRequestsQuery.limit(), func(ctx context.Context, start, end time.Time) ([]cfHttpRequestsGroup, error) {
+		var data struct {
+			Viewer struct {
+				Zones []cfHttpRequestsZone `json:"zones"`
+			} `json:"viewer"`
 		}
-
-		req.Header.Set("Authorization", cfKey)
-		req.Header.Set("Content-Type", "application/json")
-
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-		defer cancel()
-		req = req.WithContext(ctx)
-
-		httpClient := &http.Client{}
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			return CloudFlareResponse{}, fmt.Errorf("### cloudflare ### 请求失败: %v", err)
+		variables := map[string]interface{}{
+			"zoneTag": zoneId,
+			"filter": map[string]interface{}{
+				"datetime_geq": start.Format(time.RFC3339),
+				"datetime_lt":  end.Format(time.RFC3339),
+			},
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			return CloudFlareResponse{}, fmt.Errorf("### cloudflare ### 请求返回非200状态码: %d, 响应体: %s", resp.StatusCode, string(bodyBytes))
+		err := cfClient.Do(ctx, query, variables, &data)
+		if len(data.Viewer.Zones) == 0 {
+			return nil, err
 		}
-
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return CloudFlareResponse{}, fmt.Errorf("### cloudflare ### 读取响应体失败: %v", err)
-		}
-		err = json.Unmarshal(bodyBytes, &respData)
-		if err != nil {
-			return CloudFlareResponse{}, fmt.Errorf("### cloudflare ### 解析响应失败: %v", err)
-		}
-		if len(respData.Errors) > 0 {
-			firstErr := respData.Errors[0]
-			fmt.Println("### cloudflare ### API错误", "[zoneId: "+zoneId+"] [startTime: "+startTime+"] [endTime: "+endTime+"]", fmt.Sprintf("[msg: %s] [code: %s] [path: %s]", firstErr.Message, firstErr.Code, firstErr.Path))
-			if attempt < maxRetries {
-				retryCount++
-				time.Sleep(retryDelay)
-				continue
-			}
-		}
-		if len(respData.Data.Viewer.Zones[0].HttpRequestsAdaptiveGroups) == 0 {
-			fmt.Println("### cloudflare ### 无响应数据", "[zoneId: "+zoneId+"] [startTime: "+startTime+"] [endTime: "+endTime+"]")
-			if attempt < maxRetries {
-				retryCount++
-				time.Sleep(retryDelay)
-				continue
-			}
-		}
-		break
+		return data.Viewer.Zones[0].HttpRequestsAdaptiveGroups, err
+	})
+	if gqlErrs, ok := err.(cfGraphQLErrors); ok {
+		fmt.Println("### cloudflare ### API错误", "[zoneId: "+zoneId+"] [startTime: "+startTime+"] [endTime: "+endTime+"]", gqlErrs.Error())
+		respData.Errors = gqlErrs
+		err = nil
 	}
-	if retryCount == 2 {
-		fmt.Println("### cloudflare ###", "[zoneId: "+zoneId+"] [startTime: "+startTime+"] [endTime: "+endTime+"]"+" [status: API错误/无响应数据]")
-	} else {
-		fmt.Println("### cloudflare ###", "[zoneId: "+zoneId+"] [startTime: "+startTime+"] [endTime: "+endTime+"]"+" [status: success]")
+	if err != nil {
+		return CloudFlareResponse{}, err
 	}
+	respData.Data.Viewer.Zones = []cfHttpRequestsZone{{HttpRequestsAdaptiveGroups: groups, ZoneTag: zoneId}}
+	fmt.Println("### cloudflare ###", "[zoneId: "+zoneId+"] [startTime: "+startTime+"] [endTime: "+endTime+"]", fmt.Sprintf("[groups: %d]", len(groups)))
 	return respData, nil
 }
 
 func processCloudFlareData(cloudflareData CloudFlareResponse, startTimeUnix int64, zoneId, endTime string) []OutputLog {
 	countryMap := make(map[string]*OutputLog)
 	timeMap := make(map[string]time.Time)
+	durationMap := make(map[string]int)
 
 	if len(cloudflareData.Data.Viewer.Zones) == 0 {
 		return []OutputLog{}
 	}
 	zone := cloudflareData.Data.Viewer.Zones[0]
+	zoneName := cfZoneName(zone.ZoneTag)
 
 	for _, group := range zone.HttpRequestsAdaptiveGroups {
 		country := group.Dimensions.ClientCountryName
@@ -216,13 +209,23 @@ func processCloudFlareData(cloudflareData CloudFlareResponse, startTimeUnix int6
 
 		timestamp := dateTime.UnixNano() / int64(time.Millisecond)
 
-		timeKey := fmt.Sprintf("%s_%s", country, dateTime.Format("2006-01-02T15:04:05Z"))
+		host := stringToLowCase(group.Dimensions.ClientRequestHTTPHost)
+		if host == "" {
+			host = zoneName
+		}
+		if host == "" {
+			host = zone.ZoneTag
+		}
+
+		timeKey := fmt.Sprintf("%s_%s_%s", host, country, dateTime.Format("2006-01-02T15:04:05Z"))
 		log, exists := countryMap[timeKey]
 		if !exists {
 			log = &OutputLog{
 				StartTime: timestamp,
 				Country:   stringToLowCase(country),
-				Domain:    zone.ZoneTag,
+				Domain:    host,
+				Zone:      zone.ZoneTag,
+				ZoneName:  zoneName,
 			}
 			timeMap[timeKey] = dateTime
 			countryMap[timeKey] = log
@@ -232,17 +235,15 @@ func processCloudFlareData(cloudflareData CloudFlareResponse, startTimeUnix int6
 
 		responseBytes := group.Sum.EdgeResponseBytes
 		log.Flux += responseBytes
-		log.BW += responseBytes * 8
-
-		isHit := group.Dimensions.OriginResponseStatus == 0 || group.Dimensions.CacheStatus == "hit"
 
-		if isHit {
+		switch cfCacheStatusClass(group.Dimensions.CacheStatus, group.Dimensions.OriginResponseStatus) {
+		case cfCacheClassHit:
 			log.HitNum += group.Count
 			log.HitFlux += responseBytes
-		} else {
+		case cfCacheClassOrigin:
 			log.BSNum += group.Count
-			log.BSFlux += responseBytes
-			log.BSBW += responseBytes * 8
+			durationMap[timeKey] += group.Sum.OriginResponseDurationMs
+			// adaptive groups 没有回源字节数, BSFlux/BSBW 保持为 0, 回源流量以 logpush 数据 (OriginResponseBytes) 为准
 
 			if group.Dimensions.OriginResponseStatus >= 400 {
 				log.BSFailNum += group.Count
@@ -276,13 +277,40 @@ func processCloudFlareData(cloudflareData CloudFlareResponse, startTimeUnix int6
 	}
 
 	var result []OutputLog
-	for _, log := range countryMap {
+	for timeKey, log := range countryMap {
+		// 分组按分钟聚合, BW 为该分钟的平均带宽 (bps)
+		log.BW = log.Flux * 8 / 60
+		if log.BSNum > 0 {
+			log.BSDurationMs = durationMap[timeKey] / log.BSNum
+		}
 		result = append(result, *log)
 	}
 
 	return result
 }
 
+const (
+	cfCacheClassNone = iota
+	cfCacheClassHit
+	cfCacheClassOrigin
+)
+
+// cfCacheStatusClass 按 cacheStatus 判断请求由缓存响应还是真实回源
+// hit/stale/updating 由边缘缓存响应; miss/expired/bypass/dynamic/revalidated 会访问源站;
+// none/unknown 等 (如 Workers 直接响应、边缘拦截) 既不是命中也不是回源
+func cfCacheStatusClass(cacheStatus string, originResponseStatus int) int {
+	switch strings.ToLower(cacheStatus) {
+	case "hit", "stale", "updating":
+		return cfCacheClassHit
+	case "miss", "expired", "bypass", "dynamic", "revalidated":
+		if originResponseStatus == 0 {
+			return cfCacheClassNone
+		}
+		return cfCacheClassOrigin
+	}
+	return cfCacheClassNone
+}
+
 func stringToLowCase(s string) string {
 	return strings.ToLower(s)
 }
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Cloudflare Analytics GraphQL 支持的数据集
+const (
+	CFDatasetHttpRequestsAdaptiveGroups  = "httpRequestsAdaptiveGroups"
+	CFDatasetHttpRequests1mGroups        = "httpRequests1mGroups"
+	CFDatasetFirewallEventsAdaptiveGroup = "firewallEventsAdaptiveGroups"
+	CFDatasetWorkersInvocationsAdaptive  = "workersInvocationsAdaptive"
+)
+
+// cfGraphQLMaxLimit 单次查询返回的最大分组数
+const cfGraphQLMaxLimit = 9999
+
+var (
+	cfGraphQLIdentRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	cfGraphQLDatasets    = map[string]bool{
+		CFDatasetHttpRequestsAdaptiveGroups:  true,
+		CFDatasetHttpRequests1mGroups:        true,
+		CFDatasetFirewallEventsAdaptiveGroup: true,
+		CFDatasetWorkersInvocationsAdaptive:  true,
+	}
+)
+
+type cfGraphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type cfGraphQLError struct {
+	Message    string        `json:"message"`
+	Path       []interface{} `json:"path"`
+	Extensions struct {
+		Code      string `json:"code"`
+		Timestamp string `json:"timestamp"`
+		RayID     string `json:"ray_id"`
+	} `json:"extensions"`
+}
+
+// cfGraphQLErrors GraphQL 层面的错误, HTTP 状态码可能仍为 200
+type cfGraphQLErrors []cfGraphQLError
+
+func (e cfGraphQLErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, item := range e {
+		msgs = append(msgs, fmt.Sprintf("[msg: %s] [code: %s] [path: %v] [rayId: %s]",
+			item.Message, item.Extensions.Code, item.Path, item.Extensions.RayID))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// cfZoneQuery 按 zone 查询某个数据集的分组数据, 所有字段名在 Build 时校验, 取值通过 variables 传递
+type cfZoneQuery struct {
+	Dataset    string
+	Dimensions []string
+	Sums       []string
+	Avgs       []string
+	OrderBy    []string
+	Count      bool
+	Limit      int
+}
+
+func (q cfZoneQuery) Build() (string, error) {
+	if !cfGraphQLDatasets[q.Dataset] {
+		return "", fmt.Errorf("不支持的数据集: %s", q.Dataset)
+	}
+	for _, fields := range [][]string{q.Dimensions, q.Sums, q.Avgs, q.OrderBy} {
+		for _, f := range fields {
+			if !cfGraphQLIdentRegexp.MatchString(f) {
+				return "", fmt.Errorf("非法的字段名: %q", f)
+			}
+		}
+	}
+	limit := q.limit()
+
+	var sb strings.Builder
+	filterType := "Zone" + strings.ToUpper(q.Dataset[:1]) + q.Dataset[1:] + "Filter_InputObject"
+	fmt.Fprintf(&sb, "query ($zoneTag: string, $filter: %s) { viewer { zones(filter: {zoneTag: $zoneTag}) { zoneTag ", filterType)
+	fmt.Fprintf(&sb, "%s(filter: $filter, limit: %d", q.Dataset, limit)
+	if len(q.OrderBy) > 0 {
+		fmt.Fprintf(&sb, ", orderBy: [%s]", strings.Join(q.OrderBy, ", "))
+	}
+	sb.WriteString(") {")
+	if q.Count {
+		sb.WriteString(" count")
+	}
+	writeBlock := func(name string, fields []string) {
+		if len(fields) > 0 {
+			fmt.Fprintf(&sb, " %s { %s }", name, strings.Join(fields, " "))
+		}
+	}
+	writeBlock("dimensions", q.Dimensions)
+	writeBlock("sum", q.Sums)
+	writeBlock("avg", q.Avgs)
+	sb.WriteString(" } } } }")
+	return sb.String(), nil
+}
+
+func (q cfZoneQuery) limit() int {
+	if q.Limit <= 0 {
+		return cfGraphQLMaxLimit
+	}
+	return q.Limit
+}
+
+// cfQueryWindow 查询 [start, end) 的分组数据; GraphQL 没有游标, 返回条数达到 limit 时结果可能被截断,
+// 此时按分钟把窗口对半拆分后分别查询, 窗口只剩 1 分钟仍达到上限时记录日志并使用已有结果.
+// fetch 返回错误时同时返回已取到的数据
+func cfQueryWindow[T any](ctx context.Context, start, end time.Time, limit int, fetch func(ctx context.Context, start, end time.Time) ([]T, error)) ([]T, error) {
+	groups, err := fetch(ctx, start, end)
+	if err != nil || len(groups) < limit {
+		return groups, err
+	}
+	if end.Sub(start) <= time.Minute {
+		log.Printf("### cloudflare ### [startTime: %s] [endTime: %s] 1 分钟内分组数达到上限 %d, 结果不完整\n",
+			start.Format(time.RFC3339), end.Format(time.RFC3339), limit)
+		return groups, nil
+	}
+	mid := start.Add(end.Sub(start) / 2).Truncate(time.Minute)
+	if !mid.After(start) {
+		mid = start.Add(time.Minute)
+	}
+	left, err := cfQueryWindow(ctx, start, mid, limit, fetch)
+	if err != nil {
+		return left, err
+	}
+	right, err := cfQueryWindow(ctx, mid, end, limit, fetch)
+	return append(left, right...), err
+}
+
+type cfGraphQLClient struct {
+	endpoint   string
+	token      string
+	httpClient *retryHTTPClient
+}
+
+func newCFGraphQLClient(endpoint, token string) *cfGraphQLClient {
+	return &cfGraphQLClient{
+		endpoint:   endpoint,
+		token:      token,
+		httpClient: newRetryHTTPClient("cloudflare", 15*time.Second, defaultRetryPolicy, accountLimiter(token, cfGraphQLRate, cfGraphQLBurst)),
+	}
+}
+
+// Do 发送查询并把 data 解析到 out, 存在 errors 时返回 cfGraphQLErrors (out 中仍可能有部分数据)
+func (c *cfGraphQLClient) Do(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	payload, err := json.Marshal(cfGraphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		return fmt.Errorf("序列化查询失败: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Authorization", c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("### cloudflare ### 请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("### cloudflare ### 读取响应体失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("### cloudflare ### 请求返回非200状态码: %d, 响应体: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var envelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors cfGraphQLErrors `json:"errors"`
+	}
+	if err := json.Unmarshal(bodyBytes, &envelope); err != nil {
+		return fmt.Errorf("### cloudflare ### 解析响应失败: %v", err)
+	}
+	if out != nil && len(envelope.Data) > 0 && string(envelope.Data) != "null" {
+		if err := json.Unmarshal(envelope.Data, out); err != nil {
+			return fmt.Errorf("### cloudflare ### 解析响应数据失败: %v", err)
+		}
+	}
+	if len(envelope.Errors) > 0 {
+		return envelope.Errors
+	}
+	return nil
+}
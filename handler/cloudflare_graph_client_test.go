@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCFZoneQueryBuild(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   cfZoneQuery
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "字段和过滤条件类型",
+			query: cfHttpRequestsQuery,
+			want: []string{
+				"query ($zoneTag: string, $filter: ZoneHttpRequestsAdaptiveGroupsFilter_InputObject)",
+				"zones(filter: {zoneTag: $zoneTag})",
+				"httpRequestsAdaptiveGroups(filter: $filter, limit: 9999, orderBy: [datetimeMinute_ASC])",
+				"count dimensions { datetimeMinute clientRequestHTTPHost",
+				"sum { edgeResponseBytes originResponseDurationMs }",
+			},
+		},
+		{
+			name:  "未设置 limit 时使用默认值",
+			query: cfZoneQuery{Dataset: CFDatasetHttpRequests1mGroups, Sums: []string{"bytes"}},
+			want:  []string{"httpRequests1mGroups(filter: $filter, limit: 9999) { sum { bytes } }"},
+		},
+		{
+			name:    "不支持的数据集",
+			query:   cfZoneQuery{Dataset: "httpRequests"},
+			wantErr: true,
+		},
+		{
+			name:    "非法的字段名",
+			query:   cfZoneQuery{Dataset: CFDatasetHttpRequestsAdaptiveGroups, Dimensions: []string{"datetime } evil {"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := tt.query.Build()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("期望错误, 得到 %s", query)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(query, want) {
+					t.Fatalf("查询 %s 中缺少 %s", query, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCFGraphQLClientDo(t *testing.T) {
+	var got cfGraphQLRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test" {
+			t.Errorf("Authorization: %s", r.Header.Get("Authorization"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("解析请求失败: %v", err)
+		}
+		w.Write([]byte(`{"data":{"viewer":{"zones":[{"zoneTag":"z1"}]}},"errors":[{"message":"limit exceeded","path":["viewer","zones",0],"extensions":{"code":"quota","timestamp":"2024-01-01T00:00:00Z","ray_id":"ray1"}}]}`))
+	}))
+	defer srv.Close()
+
+	query, err := cfHttpRequestsQuery.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	variables := map[string]interface{}{
+		"zoneTag": "z1",
+		"filter":  map[string]interface{}{"datetime_geq": "2024-01-01T00:00:00Z"},
+	}
+	var out struct {
+		Viewer struct {
+			Zones []struct {
+				ZoneTag string `json:"zoneTag"`
+			} `json:"zones"`
+		} `json:"viewer"`
+	}
+	err = newCFGraphQLClient(srv.URL, "Bearer test").Do(context.Background(), query, variables, &out)
+
+	if got.Query != query {
+		t.Fatalf("query 为 %s", got.Query)
+	}
+	filter, _ := got.Variables["filter"].(map[string]interface{})
+	if got.Variables["zoneTag"] != "z1" || filter["datetime_geq"] != "2024-01-01T00:00:00Z" {
+		t.Fatalf("variables 为 %v", got.Variables)
+	}
+	gqlErrs, ok := err.(cfGraphQLErrors)
+	if !ok || len(gqlErrs) != 1 {
+		t.Fatalf("期望 cfGraphQLErrors, 得到 %v", err)
+	}
+	if e := gqlErrs[0]; e.Message != "limit exceeded" || e.Extensions.Code != "quota" || e.Extensions.RayID != "ray1" || len(e.Path) != 3 {
+		t.Fatalf("errors 解析为 %+v", e)
+	}
+	if len(out.Viewer.Zones) != 1 || out.Viewer.Zones[0].ZoneTag != "z1" {
+		t.Fatalf("存在 errors 时仍应解析 data, 得到 %+v", out)
+	}
+}
+
+func TestQueryCloudFlareGraphQLErrorNotRetried(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"data":null,"errors":[{"message":"bad filter","extensions":{"code":"invalid"}}]}`))
+	}))
+	defer srv.Close()
+	old := cfClient
+	cfClient = newCFGraphQLClient(srv.URL, "Bearer retry-test")
+	defer func() { cfClient = old }()
+
+	resp, err := queryCloudFlare("z1", "2024-01-01T00:00:00Z", "2024-01-01T00:05:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != "invalid" {
+		t.Fatalf("Errors 为 %+v", resp.Errors)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("GraphQL 错误不应重试, 请求了 %d 次", n)
+	}
+}
+
+func TestCFQueryWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// perMinute 模拟每分钟 n 个分组, 超过 limit 时截断
+	fetcher := func(perMinute, limit int, calls *int) func(ctx context.Context, s, e time.Time) ([]int64, error) {
+		return func(ctx context.Context, s, e time.Time) ([]int64, error) {
+			*calls++
+			var groups []int64
+			for m := s; m.Before(e); m = m.Add(time.Minute) {
+				for i := 0; i < perMinute && len(groups) < limit; i++ {
+					groups = append(groups, m.Unix())
+				}
+			}
+			return groups, nil
+		}
+	}
+	tests := []struct {
+		name      string
+		end       time.Time
+		perMinute int
+		limit     int
+		wantLen   int
+		wantCalls int
+	}{
+		{name: "未达到上限不拆分", end: start.Add(10 * time.Minute), perMinute: 1, limit: 20, wantLen: 10, wantCalls: 1},
+		{name: "达到上限时拆分窗口", end: start.Add(10 * time.Minute), perMinute: 1, limit: 4, wantLen: 10, wantCalls: 7},
+		{name: "1 分钟内达到上限时不再拆分", end: start.Add(2 * time.Minute), perMinute: 5, limit: 5, wantLen: 10, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			groups, err := cfQueryWindow(context.Background(), start, tt.end, tt.limit, fetcher(tt.perMinute, tt.limit, &calls))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(groups) != tt.wantLen || calls != tt.wantCalls {
+				t.Fatalf("得到 %d 组 %d 次请求, 期望 %d 组 %d 次请求", len(groups), calls, tt.wantLen, tt.wantCalls)
+			}
+			for i := 1; i < len(groups); i++ {
+				if groups[i] < groups[i-1] {
+					t.Fatalf("结果未按时间顺序合并: %v", groups)
+				}
+			}
+		})
+	}
+}
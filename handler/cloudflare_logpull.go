@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"bufio"
+	"cf_logpush/dto"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cfBackfillCommitLines 块内每处理这么多行落盘一次离线日志并记录已处理的 RayID
+const cfBackfillCommitLines = 1000
+
+var (
+	// Logpull 默认字段覆盖 dto.InputLog 和 dto.InputLogForDownLoad 需要的字段
+	cfLogpullDefaultFields = []string{
+		"ClientCountry", "ClientRegionCode", "ClientIP", "ClientSrcPort",
+		"ClientRequestHost", "ClientRequestMethod", "ClientRequestProtocol", "ClientRequestScheme",
+		"ClientRequestURI", "ClientRequestReferer", "ClientRequestUserAgent",
+		"EdgeStartTimestamp", "EdgeEndTimestamp", "EdgeResponseBytes", "EdgeResponseBodyBytes",
+		"EdgeResponseStatus", "EdgeServerIP", "EdgeTimeToFirstByteMs",
+		"CacheCacheStatus", "CacheResponseBytes",
+		"OriginIP", "OriginResponseStatus", "OriginResponseDurationMs", "RayID",
+	}
+
+	cfLogpullClient = newRetryHTTPClient("cloudflare-logpull", 10*time.Minute, defaultRetryPolicy, accountLimiter("logpull:"+cfKey, 1, 5))
+)
+
+// cfBackfillProgress 回补进度, DoneUntil 之前的区间已处理完成
+type cfBackfillProgress struct {
+	Zone      string `json:"zone"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	DoneUntil int64  `json:"done_until"`
+}
+
+// cfBackfillDone 正在处理的块内已处理的 RayID, 追加写入 <progress>.rays;
+// 中断后重新执行时跳过这些行, 避免整块重发到 td-agent 和离线日志, 块完成后删除
+type cfBackfillDone struct {
+	path    string
+	seen    map[string]bool
+	pending []string
+}
+
+func loadCFBackfillDone(path string) (*cfBackfillDone, error) {
+	done := &cfBackfillDone{path: path, seen: make(map[string]bool)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			done.seen[id] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+func (d *cfBackfillDone) add(rayID string) {
+	d.seen[rayID] = true
+	d.pending = append(d.pending, rayID)
+}
+
+// commit 先等离线日志写完再记录 RayID, 中断时最多重发最近未 commit 的行
+func (d *cfBackfillDone) commit() error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	FlushLogs()
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strings.Join(d.pending, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	d.pending = d.pending[:0]
+	return f.Close()
+}
+
+// reset 块完成后清空记录
+func (d *cfBackfillDone) reset() error {
+	d.seen = make(map[string]bool)
+	d.pending = nil
+	if err := os.Remove(d.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RunCloudFlareBackfill 通过 Logpull logs/received 接口回补指定 zone 和时间段的日志,
+// 逐行走 TransformLog / WriteToFile 流程重建离线日志和统计数据
+//
+//	cf_logpush cf-backfill -zone <zoneTag> -start <unix> -end <unix> [-chunk 5m] [-fields a,b] [-progress file] [-logPath dir]
+func RunCloudFlareBackfill(args []string) error {
+	fs := flag.NewFlagSet("cf-backfill", flag.ContinueOnError)
+	zone := fs.String("zone", "", "zone tag")
+	startUnix := fs.Int64("start", 0, "开始时间 (unix 秒)")
+	endUnix := fs.Int64("end", 0, "结束时间 (unix 秒)")
+	chunk := fs.Duration("chunk", 5*time.Minute, "每次请求的时间跨度, Logpull 最大 1h")
+	fields := fs.String("fields", strings.Join(cfLogpullDefaultFields, ","), "Logpull 字段")
+	progressPath := fs.String("progress", "", "进度文件, 默认在 LogPath 下")
+	logPath := fs.String("logPath", dto.LogPath, "离线日志目录")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *zone == "" || *startUnix == 0 || *endUnix <= *startUnix {
+		fs.Usage()
+		return fmt.Errorf("缺少必要参数: zone, start, end")
+	}
+	if *chunk <= 0 || *chunk > time.Hour {
+		return fmt.Errorf("chunk 取值范围 (0, 1h]")
+	}
+	dto.LogPath = *logPath
+	if *progressPath == "" {
+		*progressPath = filepath.Join(dto.LogPath, fmt.Sprintf(".cf_backfill_%s_%d_%d.json", *zone, *startUnix, *endUnix))
+	}
+
+	progress := cfBackfillProgress{Zone: *zone, Start: *startUnix, End: *endUnix, DoneUntil: *startUnix}
+	if data, err := os.ReadFile(*progressPath); err == nil {
+		var saved cfBackfillProgress
+		if err := json.Unmarshal(data, &saved); err == nil && saved.Zone == *zone && saved.Start == *startUnix && saved.End == *endUnix {
+			progress = saved
+			log.Printf("### cf-backfill ### 从 %s 继续\n", time.Unix(progress.DoneUntil, 0).UTC().Format(time.RFC3339))
+		}
+	}
+
+	done, err := loadCFBackfillDone(*progressPath + ".rays")
+	if err != nil {
+		return fmt.Errorf("读取块内进度失败: %v", err)
+	}
+	if len(done.seen) > 0 {
+		log.Printf("### cf-backfill ### 当前块已处理 %d 条, 将跳过\n", len(done.seen))
+	}
+
+	SetLogWriteBlocking(true)
+	defer FlushLogs()
+
+	end := time.Unix(*endUnix, 0).UTC()
+	for chunkStart := time.Unix(progress.DoneUntil, 0).UTC(); chunkStart.Before(end); {
+		chunkEnd := chunkStart.Add(*chunk)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		lines, err := pullCloudFlareLogs(context.Background(), *zone, chunkStart, chunkEnd, *fields, done)
+		if err != nil {
+			return fmt.Errorf("[startTime: %s] [endTime: %s] 回补失败, 可重新执行继续: %v",
+				chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), err)
+		}
+		log.Printf("### cf-backfill ### [zoneId: %s] [startTime: %s] [endTime: %s] [lines: %d]\n",
+			*zone, chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), lines)
+
+		progress.DoneUntil = chunkEnd.Unix()
+		data, _ := json.Marshal(progress)
+		if err := os.WriteFile(*progressPath, data, fileMode); err != nil {
+			return fmt.Errorf("保存进度失败: %v", err)
+		}
+		if err := done.reset(); err != nil {
+			return fmt.Errorf("清理块内进度失败: %v", err)
+		}
+		chunkStart = chunkEnd
+	}
+	log.Printf("### cf-backfill ### [zoneId: %s] 完成\n", *zone)
+	return nil
+}
+
+// pullCloudFlareLogs 拉取 [start, end) 的日志逐行处理, 跳过 done 中已处理的 RayID, 返回本次处理的行数
+func pullCloudFlareLogs(ctx context.Context, zone string, start, end time.Time, fields string, done *cfBackfillDone) (int, error) {
+	query := url.Values{}
+	query.Set("start", start.Format(time.RFC3339))
+	query.Set("end", end.Format(time.RFC3339))
+	query.Set("fields", fields)
+	query.Set("timestamps", "rfc3339")
+	u := cfApiBase + "/zones/" + url.PathEscape(zone) + "/logs/received?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", cfKey)
+	resp, err := cfLogpullClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return 0, fmt.Errorf("请求返回非200状态码: %d, 响应体: %s", resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	lines := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var id struct {
+			RayID string `json:"RayID"`
+		}
+		json.Unmarshal([]byte(line), &id)
+		if id.RayID != "" && done.seen[id.RayID] {
+			continue
+		}
+		processLogLine(detectDataset(line), line)
+		lines++
+		if id.RayID != "" {
+			done.add(id.RayID)
+		}
+		if len(done.pending) >= cfBackfillCommitLines {
+			if err := done.commit(); err != nil {
+				return lines, fmt.Errorf("保存块内进度失败: %v", err)
+			}
+		}
+	}
+	scanErr := scanner.Err()
+	if err := done.commit(); err != nil {
+		return lines, fmt.Errorf("保存块内进度失败: %v", err)
+	}
+	return lines, scanErr
+}
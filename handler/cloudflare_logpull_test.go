@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tdAgentRecorder 替换 td-agent 客户端的 Transport, 记录发送的日志
+type tdAgentRecorder struct {
+	mu    sync.Mutex
+	posts []string
+}
+
+func (r *tdAgentRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.posts = append(r.posts, string(body))
+	r.mu.Unlock()
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestRunCloudFlareBackfill(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 每个 5 分钟块返回两条日志, RayID 为 <块序号>a / <块序号>b
+	logLine := func(ray string, ts time.Time) string {
+		return fmt.Sprintf(`{"ClientRequestHost":"a.com","ClientRequestMethod":"GET","ClientRequestURI":"/x","EdgeStartTimestamp":%q,"EdgeEndTimestamp":%q,"EdgeResponseStatus":200,"EdgeResponseBytes":100,"RayID":%q}`,
+			ts.Format(time.RFC3339), ts.Add(time.Second).Format(time.RFC3339), ray)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/zones/z1/logs/received" || r.Header.Get("Authorization") != cfKey || q.Get("timestamps") != "rfc3339" || q.Get("fields") == "" {
+			t.Errorf("请求 %s %v", r.URL.Path, q)
+		}
+		chunkStart, err := time.Parse(time.RFC3339, q.Get("start"))
+		if err != nil {
+			t.Errorf("start: %s", q.Get("start"))
+		}
+		n := int(chunkStart.Sub(start) / (5 * time.Minute))
+		fmt.Fprintln(w, logLine(fmt.Sprintf("%da", n), chunkStart))
+		fmt.Fprintln(w, logLine(fmt.Sprintf("%db", n), chunkStart.Add(time.Minute)))
+	}))
+	defer srv.Close()
+
+	oldBase, oldLogPath, oldTransport := cfApiBase, dto.LogPath, tdAgentClient.client.Transport
+	defer func() {
+		cfApiBase, dto.LogPath, tdAgentClient.client.Transport = oldBase, oldLogPath, oldTransport
+		SetLogWriteBlocking(false)
+	}()
+	cfApiBase = srv.URL
+
+	tests := []struct {
+		name      string
+		doneUntil int64    // 已保存的进度, 0 表示没有进度文件
+		rays      []string // 中断前当前块已处理的 RayID
+		wantPosts int
+	}{
+		{name: "从头回补", wantPosts: 4},
+		{name: "从已完成的块之后继续", doneUntil: start.Add(5 * time.Minute).Unix(), wantPosts: 2},
+		{name: "块内已处理的行不重发", doneUntil: start.Unix(), rays: []string{"0a"}, wantPosts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &tdAgentRecorder{}
+			tdAgentClient.client.Transport = recorder
+			// 不带结尾的 /, 确认路径按 filepath.Join 拼接
+			logPath := filepath.Join(t.TempDir(), "logs")
+			progress := filepath.Join(t.TempDir(), "progress.json")
+			end := start.Add(10 * time.Minute)
+			if tt.doneUntil > 0 {
+				data, _ := json.Marshal(cfBackfillProgress{Zone: "z1", Start: start.Unix(), End: end.Unix(), DoneUntil: tt.doneUntil})
+				os.WriteFile(progress, data, fileMode)
+			}
+			if len(tt.rays) > 0 {
+				os.WriteFile(progress+".rays", []byte(strings.Join(tt.rays, "\n")+"\n"), fileMode)
+			}
+
+			err := RunCloudFlareBackfill([]string{
+				"-zone", "z1",
+				"-start", fmt.Sprint(start.Unix()),
+				"-end", fmt.Sprint(end.Unix()),
+				"-progress", progress,
+				"-logPath", logPath,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recorder.posts) != tt.wantPosts {
+				t.Fatalf("发送到 td-agent %d 条, 期望 %d 条", len(recorder.posts), tt.wantPosts)
+			}
+
+			var saved cfBackfillProgress
+			data, _ := os.ReadFile(progress)
+			if err := json.Unmarshal(data, &saved); err != nil || saved.DoneUntil != end.Unix() {
+				t.Fatalf("进度为 %s", data)
+			}
+			if _, err := os.Stat(progress + ".rays"); !os.IsNotExist(err) {
+				t.Fatalf("块完成后应删除块内进度: %v", err)
+			}
+			// 离线日志按东八区时间写在 logPath/<日期>/<5分钟>-<域名>
+			if _, err := os.Stat(filepath.Join(logPath, "20240101", "202401010805-a.com")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cfPollSinkTDAgent = "td-agent"
+	cfPollSinkES      = "es"
+
+	cfPollMaxChunk = 15 * time.Minute
+)
+
+type cfPollerConfig struct {
+	Zones         map[string]string // zoneTag -> tenantId
+	Interval      time.Duration
+	Lag           time.Duration
+	MaxBackfill   time.Duration
+	CheckpointDir string
+	Sinks         []string
+}
+
+// cfPollCheckpoint Sent 为从 LastEnd 开始的块中途失败时已发送的记录, 重试该块时跳过, 避免 td-agent 收到重复数据.
+// 只在发送失败时保存, 进程在块中途退出时该块已发送的记录仍会重复发送一次
+type cfPollCheckpoint struct {
+	Zone      string   `json:"zone"`
+	LastEnd   int64    `json:"last_end"`
+	UpdatedAt int64    `json:"updated_at"`
+	Sent      []string `json:"sent,omitempty"`
+}
+
+var (
+	cfPollerOnce sync.Once
+)
+
+// loadCFPollerConfig 从环境变量读取轮询配置, CF_POLL_ZONES 为空时不启动
+// CF_POLL_ZONES 格式: zoneTag[:tenantId],zoneTag[:tenantId]
+func loadCFPollerConfig() cfPollerConfig {
+	conf := cfPollerConfig{
+		Zones:         make(map[string]string),
+		Interval:      envMinutes("CF_POLL_INTERVAL_MIN", 5),
+		Lag:           envMinutes("CF_POLL_LAG_MIN", 3),
+		MaxBackfill:   time.Duration(envInt("CF_POLL_MAX_BACKFILL_HOURS", 24)) * time.Hour,
+		CheckpointDir: os.Getenv("CF_POLL_CHECKPOINT_DIR"),
+	}
+	for _, item := range strings.Split(os.Getenv("CF_POLL_ZONES"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		zone, tenant, _ := strings.Cut(item, ":")
+		conf.Zones[zone] = tenant
+	}
+	if conf.CheckpointDir == "" {
+		conf.CheckpointDir = filepath.Join(dto.LogPath, ".cf_checkpoint")
+	}
+	sinks := os.Getenv("CF_POLL_SINKS")
+	if sinks == "" {
+		sinks = cfPollSinkTDAgent
+	}
+	for _, sink := range strings.Split(sinks, ",") {
+		if sink = strings.TrimSpace(sink); sink != "" {
+			conf.Sinks = append(conf.Sinks, sink)
+		}
+	}
+	return conf
+}
+
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+func envMinutes(key string, def int) time.Duration {
+	return time.Duration(envInt(key, def)) * time.Minute
+}
+
+// StartCloudFlarePoller 定时拉取配置的 zone 数据并推送到 td-agent / ES
+func StartCloudFlarePoller() {
+	cfPollerOnce.Do(func() {
+		conf := loadCFPollerConfig()
+		if len(conf.Zones) == 0 {
+			return
+		}
+		if err := os.MkdirAll(conf.CheckpointDir, os.ModePerm); err != nil {
+			log.Printf("### cloudflare-poller ### 创建 checkpoint 目录失败: %v\n", err)
+			return
+		}
+		log.Printf("### cloudflare-poller ### 启动, zones: %d, interval: %v, lag: %v, sinks: %v\n",
+			len(conf.Zones), conf.Interval, conf.Lag, conf.Sinks)
+		go func() {
+			ticker := time.NewTicker(conf.Interval)
+			defer ticker.Stop()
+			for {
+				for zone, tenant := range conf.Zones {
+					pollCloudFlareZone(conf, zone, tenant)
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+func pollCloudFlareZone(conf cfPollerConfig, zone, tenant string) {
+	end := time.Now().UTC().Add(-conf.Lag).Truncate(time.Minute)
+	start := end.Add(-conf.Interval)
+
+	cp, err := loadCFPollCheckpoint(conf.CheckpointDir, zone)
+	if err != nil {
+		log.Printf("### cloudflare-poller ### [zoneId: %s] 读取 checkpoint 失败: %v\n", zone, err)
+	} else if cp.LastEnd > 0 {
+		start = time.Unix(cp.LastEnd, 0).UTC()
+	}
+	if end.Sub(start) > conf.MaxBackfill {
+		log.Printf("### cloudflare-poller ### [zoneId: %s] 缺口超过 %v, 丢弃 %s 至 %s 的数据\n",
+			zone, conf.MaxBackfill, start.Format(time.RFC3339), end.Add(-conf.MaxBackfill).Format(time.RFC3339))
+		start = end.Add(-conf.MaxBackfill)
+	}
+
+	sent := make(map[string]bool)
+	if start.Unix() == cp.LastEnd {
+		for _, key := range cp.Sent {
+			sent[key] = true
+		}
+	}
+	for chunkStart := start; chunkStart.Before(end); {
+		chunkEnd := chunkStart.Add(cfPollMaxChunk)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		if err := pollCloudFlareWindow(conf, zone, tenant, chunkStart, chunkEnd, sent); err != nil {
+			log.Printf("### cloudflare-poller ### [zoneId: %s] [startTime: %s] [endTime: %s] 拉取失败, 下次重试: %v\n",
+				zone, chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), err)
+			if len(sent) > 0 {
+				partial := cfPollCheckpoint{Zone: zone, LastEnd: chunkStart.Unix(), UpdatedAt: time.Now().Unix()}
+				for key := range sent {
+					partial.Sent = append(partial.Sent, key)
+				}
+				sort.Strings(partial.Sent)
+				if err := saveCFPollCheckpoint(conf.CheckpointDir, partial); err != nil {
+					log.Printf("### cloudflare-poller ### [zoneId: %s] 保存 checkpoint 失败: %v\n", zone, err)
+				}
+			}
+			return
+		}
+		if err := saveCFPollCheckpoint(conf.CheckpointDir, cfPollCheckpoint{
+			Zone:      zone,
+			LastEnd:   chunkEnd.Unix(),
+			UpdatedAt: time.Now().Unix(),
+		}); err != nil {
+			log.Printf("### cloudflare-poller ### [zoneId: %s] 保存 checkpoint 失败: %v\n", zone, err)
+			return
+		}
+		sent = make(map[string]bool)
+		chunkStart = chunkEnd
+	}
+}
+
+// pollCloudFlareWindow sent 记录已成功发送的 sink/记录, 已在其中的记录不再发送
+func pollCloudFlareWindow(conf cfPollerConfig, zone, tenant string, start, end time.Time, sent map[string]bool) error {
+	startTime := start.Format(time.RFC3339)
+	endTime := end.Format(time.RFC3339)
+	data, err := queryCloudFlare(zone, startTime, endTime)
+	if err != nil {
+		return err
+	}
+	if len(data.Errors) > 0 {
+		return data.Errors
+	}
+
+	outputLogs := processCloudFlareData(data, start.UnixMilli(), zone, endTime)
+	for _, sink := range conf.Sinks {
+		for _, item := range outputLogs {
+			d := item.toDTO(tenant)
+			key := fmt.Sprintf("%s|%s|%s|%d", sink, d.Domain, d.Country, d.StartTime)
+			if sent[key] {
+				continue
+			}
+			switch sink {
+			case cfPollSinkTDAgent:
+				outputJSON, err := json.Marshal(d)
+				if err != nil {
+					return err
+				}
+				if err := SendToTDAgent(string(outputJSON)); err != nil {
+					return err
+				}
+			case cfPollSinkES:
+				if err := sendToESWithInterval(d, StatisticalData, 60); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("未知的 sink: %s", sink)
+			}
+			sent[key] = true
+		}
+	}
+	fmt.Println("### cloudflare-poller ###", "[zoneId: "+zone+"] [startTime: "+startTime+"] [endTime: "+endTime+"]", fmt.Sprintf("[records: %d]", len(outputLogs)))
+	return nil
+}
+
+func (l OutputLog) toDTO(tenantId string) dto.OutputLog {
+	return dto.OutputLog{
+		StartTime:     l.StartTime,
+		Country:       l.Country,
+		Region:        l.Region,
+		Domain:        l.Domain,
+		Zone:          l.Zone,
+		ZoneName:      l.ZoneName,
+		BW:            l.BW,
+		Flux:          l.Flux,
+		BSBW:          l.BSBW,
+		BSFlux:        l.BSFlux,
+		ReqNum:        l.ReqNum,
+		HitNum:        l.HitNum,
+		BSNum:         l.BSNum,
+		BSFailNum:     l.BSFailNum,
+		HitFlux:       l.HitFlux,
+		HTTPCode2XX:   l.HTTPCode2XX,
+		HTTPCode3XX:   l.HTTPCode3XX,
+		HTTPCode4XX:   l.HTTPCode4XX,
+		HTTPCode5XX:   l.HTTPCode5XX,
+		BSHTTPCode2XX: l.BSHTTPCode2XX,
+		BSHTTPCode3XX: l.BSHTTPCode3XX,
+		BSHTTPCode4XX: l.BSHTTPCode4XX,
+		BSHTTPCode5XX: l.BSHTTPCode5XX,
+		BSDurationMs:  l.BSDurationMs,
+		TenantId:      tenantId,
+		TimeLocal:     l.StartTime,
+	}
+}
+
+func cfPollCheckpointPath(dir, zone string) string {
+	return filepath.Join(dir, zone+".json")
+}
+
+func loadCFPollCheckpoint(dir, zone string) (cfPollCheckpoint, error) {
+	var cp cfPollCheckpoint
+	data, err := os.ReadFile(cfPollCheckpointPath(dir, zone))
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	err = json.Unmarshal(data, &cp)
+	return cp, err
+}
+
+// saveCFPollCheckpoint 先写临时文件再 rename, 避免进程中断时留下半截文件
+func saveCFPollCheckpoint(dir string, cp cfPollCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	path := cfPollCheckpointPath(dir, cp.Zone)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, fileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingTDAgent 第 failAt 次请求返回 400 (不重试), 其余请求成功并记录
+type failingTDAgent struct {
+	mu     sync.Mutex
+	calls  int
+	failAt int
+	posts  []dto.OutputLog
+}
+
+func (f *failingTDAgent) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	status := http.StatusOK
+	if f.calls == f.failAt {
+		status = http.StatusBadRequest
+	} else {
+		var d dto.OutputLog
+		json.NewDecoder(req.Body).Decode(&d)
+		f.posts = append(f.posts, d)
+	}
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestPollCloudFlareZone(t *testing.T) {
+	// 每个窗口的第一分钟返回两个国家的分组
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req cfGraphQLRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		filter, _ := req.Variables["filter"].(map[string]interface{})
+		minute := filter["datetime_geq"]
+		fmt.Fprintf(w, `{"data":{"viewer":{"zones":[{"zoneTag":"z1","httpRequestsAdaptiveGroups":[
+			{"count":2,"dimensions":{"clientCountryName":"US","clientRequestHTTPHost":"a.com","datetimeMinute":%q,"edgeResponseStatus":200},"sum":{"edgeResponseBytes":6000}},
+			{"count":1,"dimensions":{"clientCountryName":"JP","clientRequestHTTPHost":"a.com","datetimeMinute":%q,"edgeResponseStatus":200},"sum":{"edgeResponseBytes":600}},
+			{"count":2,"dimensions":{"cacheStatus":"miss","clientCountryName":"US","clientRequestHTTPHost":"a.com","datetimeMinute":%q,"edgeResponseStatus":200,"originResponseStatus":200},"sum":{"originResponseDurationMs":300}}
+		]}]}}}`, minute, minute, minute)
+	}))
+	defer srv.Close()
+	oldClient, oldTransport := cfClient, tdAgentClient.client.Transport
+	defer func() { cfClient, tdAgentClient.client.Transport = oldClient, oldTransport }()
+	cfClient = newCFGraphQLClient(srv.URL, "Bearer poll-test")
+	cfZoneNames.Store("z1", cfZoneNameEntry{name: "a.com", expiresAt: time.Now().Add(time.Hour)})
+
+	tdAgent := &failingTDAgent{failAt: 2}
+	tdAgentClient.client.Transport = tdAgent
+	conf := cfPollerConfig{
+		Interval:      5 * time.Minute,
+		MaxBackfill:   time.Hour,
+		CheckpointDir: t.TempDir(),
+		Sinks:         []string{cfPollSinkTDAgent},
+	}
+
+	// 第一次发送第二条记录失败, checkpoint 记录已发送的第一条
+	pollCloudFlareZone(conf, "z1", "t1")
+	cp, err := loadCFPollCheckpoint(conf.CheckpointDir, "z1")
+	if err != nil || len(cp.Sent) != 1 || len(tdAgent.posts) != 1 {
+		t.Fatalf("checkpoint %+v, 已发送 %d 条", cp, len(tdAgent.posts))
+	}
+
+	// 重试同一块时只发送剩余的记录
+	windowStart := cp.LastEnd
+	pollCloudFlareZone(conf, "z1", "t1")
+	if len(tdAgent.posts) != 2 || tdAgent.posts[0].Country == tdAgent.posts[1].Country {
+		t.Fatalf("td-agent 收到 %+v", tdAgent.posts)
+	}
+	cp, _ = loadCFPollCheckpoint(conf.CheckpointDir, "z1")
+	if len(cp.Sent) != 0 || cp.LastEnd <= windowStart {
+		t.Fatalf("块完成后 checkpoint 为 %+v", cp)
+	}
+
+	// BW 为分钟平均带宽: 字节数 * 8 / 60; 回源耗时为回源请求的平均值
+	want := map[string][2]int{"us": {800, 150}, "jp": {80, 0}}
+	for _, d := range tdAgent.posts {
+		if w := want[d.Country]; d.BW != w[0] || d.BSDurationMs != w[1] || d.TenantId != "t1" {
+			t.Fatalf("记录 %+v", d)
+		}
+	}
+}
+
+func TestOutputLogJSONShape(t *testing.T) {
+	// /cloudFlare/onTimeLog 的返回中 bs_flux/bs_bw 即使为 0 也保留
+	data, _ := json.Marshal(OutputLog{BSDurationMs: 5})
+	for _, field := range []string{`"bs_flux":0`, `"bs_bw":0`, `"bs_duration_ms":5`} {
+		if !strings.Contains(string(data), field) {
+			t.Fatalf("%s 中缺少 %s", data, field)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	cfApiBase = "https://api.cloudflare.com/client/v4"
+
+	cfZoneNameTTL     = 6 * time.Hour
+	cfZoneNameFailTTL = 5 * time.Minute
+	cfZoneNames       sync.Map
+
+	// REST API 配额为每个用户 5 分钟 1200 次
+	cfRestClient = newRetryHTTPClient("cloudflare-api", 15*time.Second, defaultRetryPolicy, accountLimiter("rest:"+cfKey, 4, 20))
+)
+
+type cfZoneNameEntry struct {
+	name      string
+	expiresAt time.Time
+}
+
+type cfZoneDetailResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"result"`
+}
+
+// cfZoneName 通过 zones API 把 zoneTag 解析成域名, 结果带过期时间缓存, 查询失败返回空字符串
+func cfZoneName(zoneTag string) string {
+	if v, ok := cfZoneNames.Load(zoneTag); ok {
+		entry := v.(cfZoneNameEntry)
+		if time.Now().Before(entry.expiresAt) {
+			return entry.name
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	name, err := fetchCFZoneName(ctx, zoneTag)
+	ttl := cfZoneNameTTL
+	if err != nil {
+		log.Printf("### cloudflare ### [zoneId: %s] 查询 zone 名称失败: %v\n", zoneTag, err)
+		ttl = cfZoneNameFailTTL
+	}
+	cfZoneNames.Store(zoneTag, cfZoneNameEntry{name: name, expiresAt: time.Now().Add(ttl)})
+	return name
+}
+
+func fetchCFZoneName(ctx context.Context, zoneTag string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfApiBase+"/zones/"+url.PathEscape(zoneTag), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", cfKey)
+	resp, err := cfRestClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("请求返回非200状态码: %d, 响应体: %s", resp.StatusCode, string(body))
+	}
+	var detail cfZoneDetailResponse
+	if err := json.Unmarshal(body, &detail); err != nil {
+		return "", err
+	}
+	if !detail.Success {
+		if len(detail.Errors) > 0 {
+			return "", fmt.Errorf("[code: %d] [msg: %s]", detail.Errors[0].Code, detail.Errors[0].Message)
+		}
+		return "", fmt.Errorf("zones API 返回失败")
+	}
+	return detail.Result.Name, nil
+}
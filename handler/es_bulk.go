@@ -0,0 +1,511 @@
+package handler
+
+import (
+	"bufio"
+	"cf_logpush/dto"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	esAckSync  = "sync"
+	esAckAsync = "async"
+
+	esStatusIndexed  = "indexed"
+	esStatusQueued   = "queued"
+	esStatusSpooled  = "spooled"
+	esStatusConflict = "conflict"
+
+	// create 模式下相同 _id 的文档已存在时拒绝写入, index 模式后写覆盖
+	esWriteCreate = "create"
+	esWriteIndex  = "index"
+)
+
+var (
+	esBulkIndexed  = expvar.NewInt("es_bulk_indexed")
+	esBulkFailed   = expvar.NewInt("es_bulk_failed")
+	esBulkRetried  = expvar.NewInt("es_bulk_retried")
+	esBulkSpooled  = expvar.NewInt("es_bulk_spooled")
+	esBulkQueue    = expvar.NewInt("es_bulk_queue")
+	esBulkConflict = expvar.NewInt("es_bulk_conflicts")
+
+	esBulk     *esBulkIndexer
+	esBulkOnce sync.Once
+
+	errESSpooled  = errors.New("ES 不可用, 数据已写入本地 spool")
+	errESConflict = errors.New("文档已存在")
+)
+
+type esBulkConfig struct {
+	Workers     int
+	Actions     int
+	Bytes       int
+	Interval    time.Duration
+	QueueSize   int
+	MaxAttempts int
+	SpoolDir    string
+	Replay      time.Duration
+	WriteMode   string
+	// EnqueueWait 队列满时等待入队的时间, 超时后才写 spool, 让发送方随 ES 的写入速度减速
+	EnqueueWait time.Duration
+}
+
+// esBulkItem 一条待写入的文档, done 不为空时写入结果(成功/失败/spool)会回传给调用方
+type esBulkItem struct {
+	Index   string          `json:"index"`
+	ID      string          `json:"id,omitempty"`
+	Body    json.RawMessage `json:"body"`
+	attempt int
+	done    chan error
+}
+
+func (it *esBulkItem) finish(err error) {
+	if it.done != nil {
+		it.done <- err
+	}
+}
+
+// esBulkIndexer 批量写 ES: 按条数/大小/时间间隔刷新, 单条失败按退避重试,
+// 整批请求失败或重试次数用尽时写入本地 spool, 定时重放
+type esBulkIndexer struct {
+	conf    esBulkConfig
+	items   chan *esBulkItem
+	spoolMu sync.Mutex
+
+	// enqueueMu 保证 stop 之后不会再有数据进入队列
+	enqueueMu sync.RWMutex
+	stopped   atomic.Bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+	workers   sync.WaitGroup
+}
+
+func loadESBulkConfig() esBulkConfig {
+	conf := esBulkConfig{
+		Workers:     envInt("ES_BULK_WORKERS", 2),
+		Actions:     envInt("ES_BULK_ACTIONS", 500),
+		Bytes:       envInt("ES_BULK_SIZE_KB", 5*1024) * 1024,
+		Interval:    time.Duration(envInt("ES_BULK_FLUSH_MS", 1000)) * time.Millisecond,
+		QueueSize:   envInt("ES_BULK_QUEUE", 10000),
+		MaxAttempts: envInt("ES_BULK_MAX_ATTEMPTS", defaultRetryPolicy.MaxAttempts),
+		SpoolDir:    os.Getenv("ES_SPOOL_DIR"),
+		Replay:      envMinutes("ES_SPOOL_REPLAY_MIN", 1),
+		WriteMode:   os.Getenv("ES_WRITE_MODE"),
+		EnqueueWait: time.Duration(envInt("ES_BULK_ENQUEUE_WAIT_MS", 5000)) * time.Millisecond,
+	}
+	if conf.WriteMode != esWriteCreate {
+		conf.WriteMode = esWriteIndex
+	}
+	if conf.SpoolDir == "" {
+		conf.SpoolDir = filepath.Join(dto.LogPath, ".es_spool")
+	}
+	return conf
+}
+
+// StartESBulk 启动批量写入 worker 和 spool 重放, 首次写 ES 时也会自动启动
+func StartESBulk() {
+	getESBulk()
+}
+
+func getESBulk() *esBulkIndexer {
+	esBulkOnce.Do(func() {
+		conf := loadESBulkConfig()
+		if err := os.MkdirAll(conf.SpoolDir, os.ModePerm); err != nil {
+			log.Printf("### es-bulk ### 创建 spool 目录失败: %v\n", err)
+		}
+		esBulk = newESBulkIndexer(conf)
+	})
+	return esBulk
+}
+
+func newESBulkIndexer(conf esBulkConfig) *esBulkIndexer {
+	b := &esBulkIndexer{conf: conf, items: make(chan *esBulkItem, conf.QueueSize), stop: make(chan struct{})}
+	for i := 0; i < conf.Workers; i++ {
+		b.workers.Add(1)
+		go b.worker()
+	}
+	go b.replayLoop()
+	return b
+}
+
+// esAckMode 请求参数 ack=async|sync 优先, 其次 ES_ACK_MODE, 默认同步确认
+func esAckMode(r *http.Request) string {
+	mode := r.URL.Query().Get("ack")
+	if mode == "" {
+		mode = os.Getenv("ES_ACK_MODE")
+	}
+	if mode == esAckAsync {
+		return esAckAsync
+	}
+	return esAckSync
+}
+
+// StopESBulk 进程退出前调用: 停止接收新数据, 等待 worker 写完手中的批次,
+// 超过 timeout 或队列中仍有剩余时写入 spool, 下次启动后重放
+func StopESBulk(timeout time.Duration) {
+	if esBulk != nil {
+		esBulk.shutdown(timeout)
+	}
+}
+
+func (b *esBulkIndexer) shutdown(timeout time.Duration) {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+		b.enqueueMu.Lock()
+		b.stopped.Store(true)
+		b.enqueueMu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			b.workers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			log.Printf("### es-bulk ### 等待批量写入超时 (%v)\n", timeout)
+		}
+		var rest []*esBulkItem
+		for {
+			select {
+			case item := <-b.items:
+				esBulkQueue.Add(-1)
+				rest = append(rest, item)
+				continue
+			default:
+			}
+			break
+		}
+		if len(rest) > 0 {
+			b.spoolAndFinish(rest)
+			log.Printf("### es-bulk ### 退出前 %d 条未写入 ES, 已写入 spool\n", len(rest))
+		}
+	})
+}
+
+// enqueue 队列满时最多等待 wait, 超时或已停止时返回 false
+func (b *esBulkIndexer) enqueue(item *esBulkItem, wait time.Duration) bool {
+	b.enqueueMu.RLock()
+	defer b.enqueueMu.RUnlock()
+	if b.stopped.Load() {
+		return false
+	}
+	select {
+	case b.items <- item:
+		esBulkQueue.Add(1)
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case b.items <- item:
+		esBulkQueue.Add(1)
+		return true
+	case <-timer.C:
+		return false
+	case <-b.stop:
+		return false
+	}
+}
+
+// submit wait 为 true 时等待写入结果; 队列满时等待 EnqueueWait, 仍无法入队才写 spool
+func (b *esBulkIndexer) submit(index, id string, body interface{}, wait bool) (string, error) {
+	item, status, err := b.begin(index, id, body, wait)
+	if err != nil || item == nil || !wait {
+		return status, err
+	}
+	return b.await(item)
+}
+
+// begin 只入队不等待结果, wait 为 true 时返回的 item 用 await 取结果; 批量提交时先全部入队再依次 await
+func (b *esBulkIndexer) begin(index, id string, body interface{}, wait bool) (*esBulkItem, string, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, "", err
+	}
+	item := &esBulkItem{Index: index, ID: id, Body: raw}
+	if wait {
+		item.done = make(chan error, 1)
+	}
+	if !b.enqueue(item, b.conf.EnqueueWait) {
+		if err := b.spool([]*esBulkItem{item}); err != nil {
+			return nil, "", err
+		}
+		return nil, esStatusSpooled, nil
+	}
+	return item, esStatusQueued, nil
+}
+
+func (b *esBulkIndexer) await(item *esBulkItem) (string, error) {
+	err := <-item.done
+	if err == errESSpooled {
+		return esStatusSpooled, nil
+	}
+	if err == errESConflict {
+		return esStatusConflict, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return esStatusIndexed, nil
+}
+
+func (b *esBulkIndexer) worker() {
+	defer b.workers.Done()
+	ticker := time.NewTicker(b.conf.Interval)
+	defer ticker.Stop()
+	var (
+		batch []*esBulkItem
+		size  int
+	)
+	flush := func() {
+		if len(batch) > 0 {
+			b.flush(batch)
+		}
+		batch, size = nil, 0
+	}
+	for {
+		select {
+		case item := <-b.items:
+			esBulkQueue.Add(-1)
+			batch = append(batch, item)
+			size += len(item.Body)
+			if len(batch) >= b.conf.Actions || size >= b.conf.Bytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-b.stop:
+			flush()
+			return
+		}
+	}
+}
+
+func (b *esBulkIndexer) flush(batch []*esBulkItem) {
+	if esClient == nil {
+		b.spoolAndFinish(batch)
+		return
+	}
+	bulk := esClient.Bulk()
+	for _, item := range batch {
+		req := elastic.NewBulkIndexRequest().Index(item.Index).Doc(item.Body)
+		if item.ID != "" {
+			req = req.Id(item.ID)
+			if b.conf.WriteMode == esWriteCreate {
+				req = req.OpType(esWriteCreate)
+			}
+		}
+		bulk.Add(req)
+	}
+
+	var (
+		resp *elastic.BulkResponse
+		err  error
+	)
+	// 整批失败(网络错误、ES 不可用)时按退避重试整批, 仍失败则写 spool
+	for attempt := 1; attempt <= b.conf.MaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		resp, err = bulk.Do(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		log.Printf("### es-bulk ### [items: %d] [attempt: %d] 批量写入失败: %v\n", len(batch), attempt, err)
+		if attempt < b.conf.MaxAttempts {
+			time.Sleep(defaultRetryPolicy.Backoff(attempt))
+		}
+	}
+	if err != nil {
+		b.spoolAndFinish(batch)
+		return
+	}
+
+	for i, item := range batch {
+		var result *elastic.BulkResponseItem
+		if i < len(resp.Items) {
+			for _, r := range resp.Items[i] {
+				result = r
+			}
+		}
+		if result == nil {
+			// 响应条数与请求不一致, 按可重试的失败处理
+			result = &elastic.BulkResponseItem{
+				Status: http.StatusInternalServerError,
+				Error:  &elastic.ErrorDetails{Type: "missing_item", Reason: "bulk 响应中缺少该条结果"},
+			}
+		}
+		if result.Status >= 200 && result.Status < 300 {
+			esBulkIndexed.Add(1)
+			item.finish(nil)
+			continue
+		}
+		b.retryItem(item, result)
+	}
+}
+
+// retryItem 单条失败: 409 为 create 模式下的重复文档; 429/5xx 和索引写入锁 (es-indices 迁移期间的
+// cluster_block_exception) 退避后重新入队, 次数用尽写 spool; 其他错误(mapping 等)直接返回失败
+func (b *esBulkIndexer) retryItem(item *esBulkItem, result *elastic.BulkResponseItem) {
+	if result.Status == http.StatusConflict {
+		esBulkConflict.Add(1)
+		item.finish(errESConflict)
+		return
+	}
+	reason := fmt.Sprintf("status %d", result.Status)
+	if result.Error != nil {
+		reason = result.Error.Type + ": " + result.Error.Reason
+	}
+	if !esRetryableItem(result) {
+		esBulkFailed.Add(1)
+		log.Printf("### es-bulk ### [index: %s] [id: %s] 写入失败: %s\n", item.Index, item.ID, reason)
+		item.finish(fmt.Errorf("推送数据到 ES 失败: %s", reason))
+		return
+	}
+	item.attempt++
+	if item.attempt >= b.conf.MaxAttempts {
+		b.spoolAndFinish([]*esBulkItem{item})
+		return
+	}
+	esBulkRetried.Add(1)
+	time.AfterFunc(defaultRetryPolicy.Backoff(item.attempt), func() {
+		if !b.enqueue(item, 0) {
+			b.spoolAndFinish([]*esBulkItem{item})
+		}
+	})
+}
+
+func esRetryableItem(result *elastic.BulkResponseItem) bool {
+	if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+		return true
+	}
+	return result.Status == http.StatusForbidden && result.Error != nil && result.Error.Type == "cluster_block_exception"
+}
+
+func (b *esBulkIndexer) spoolAndFinish(items []*esBulkItem) {
+	err := b.spool(items)
+	if err == nil {
+		err = errESSpooled
+	}
+	for _, item := range items {
+		item.finish(err)
+	}
+}
+
+// spool 追加到 <SpoolDir>/spool-<yyyymmddhh>.ndjson, 每行一条 esBulkItem
+func (b *esBulkIndexer) spool(items []*esBulkItem) error {
+	b.spoolMu.Lock()
+	defer b.spoolMu.Unlock()
+	path := filepath.Join(b.conf.SpoolDir, "spool-"+time.Now().Format("2006010215")+".ndjson")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+	if err != nil {
+		log.Printf("### es-bulk ### 写入 spool 失败, 丢弃 %d 条: %v\n", len(items), err)
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, item := range items {
+		line, _ := json.Marshal(item)
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	esBulkSpooled.Add(int64(len(items)))
+	return nil
+}
+
+func (b *esBulkIndexer) replayLoop() {
+	ticker := time.NewTicker(b.conf.Replay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.replaySpool()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// replaySpool 逐个文件重放, 先改名为 .replaying 避免与新写入冲突; 重放仍失败的数据会重新进入 spool
+func (b *esBulkIndexer) replaySpool() {
+	b.spoolMu.Lock()
+	files, _ := filepath.Glob(filepath.Join(b.conf.SpoolDir, "spool-*.ndjson"))
+	sort.Strings(files)
+	var replaying []string
+	for _, file := range files {
+		target := strings.TrimSuffix(file, ".ndjson") + ".replaying"
+		if err := os.Rename(file, target); err == nil {
+			replaying = append(replaying, target)
+		}
+	}
+	b.spoolMu.Unlock()
+	leftovers, _ := filepath.Glob(filepath.Join(b.conf.SpoolDir, "spool-*.replaying"))
+	for _, file := range leftovers {
+		if !containsString(replaying, file) {
+			replaying = append(replaying, file)
+		}
+	}
+
+	for _, file := range replaying {
+		n, err := b.replayFile(file)
+		if err != nil {
+			log.Printf("### es-bulk ### [file: %s] 重放失败: %v\n", file, err)
+			continue
+		}
+		os.Remove(file)
+		fmt.Println("### es-bulk ###", "[file: "+filepath.Base(file)+"]", fmt.Sprintf("[replayed: %d]", n))
+	}
+}
+
+func (b *esBulkIndexer) replayFile(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	n := 0
+	for scanner.Scan() {
+		item := &esBulkItem{}
+		if err := json.Unmarshal(scanner.Bytes(), item); err != nil || item.Index == "" {
+			continue
+		}
+		// 停止时保留文件, 下次启动重新重放; 已入队的条目 ID 确定, 重复写入不会产生新文档
+		if !b.enqueue(item, time.Hour) {
+			return n, fmt.Errorf("重放中止, 已入队 %d 条", n)
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
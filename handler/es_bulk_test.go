@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+func TestESBulkWriteBlock(t *testing.T) {
+	tests := []struct {
+		name        string
+		unblock     bool // 第一次写入被拒绝后解除写入锁
+		wantStatus  string
+		wantSpooled int
+	}{
+		{name: "迁移结束后重试写入成功", unblock: true, wantStatus: esStatusIndexed},
+		{name: "写入锁一直存在时写入 spool", wantStatus: esStatusSpooled, wantSpooled: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var blocked, calls int32 = 1, 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				status, errBody := 201, ""
+				if atomic.LoadInt32(&blocked) == 1 {
+					// es-indices 迁移时原索引设置了 index.blocks.write
+					status, errBody = 403, `,"error":{"type":"cluster_block_exception","reason":"index [x] blocked by: [FORBIDDEN/8/index write (api)];"}`
+					if tt.unblock {
+						atomic.StoreInt32(&blocked, 0)
+					}
+				}
+				var items []string
+				sc := bufio.NewScanner(r.Body)
+				for i := 0; sc.Scan(); i++ {
+					if i%2 == 0 {
+						items = append(items, fmt.Sprintf(`{"index":{"_index":"x","status":%d%s}}`, status, errBody))
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+			}))
+			defer srv.Close()
+			client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := esClient
+			esClient = client
+			defer func() { esClient = old }()
+
+			dir := t.TempDir()
+			b := newESBulkIndexer(esBulkConfig{Workers: 1, Actions: 10, Bytes: 1 << 20, Interval: 10 * time.Millisecond,
+				QueueSize: 10, MaxAttempts: 2, SpoolDir: dir, Replay: time.Hour, WriteMode: esWriteIndex})
+			defer b.shutdown(time.Second)
+
+			status, err := b.submit("x", "id1", map[string]int{"flux": 1}, true)
+			if err != nil || status != tt.wantStatus {
+				t.Fatalf("写入结果 %q %v, 期望 %q", status, err, tt.wantStatus)
+			}
+			if n := atomic.LoadInt32(&calls); n != 2 && tt.unblock {
+				t.Fatalf("bulk 请求 %d 次, 期望 2 次", n)
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "spool-*.ndjson"))
+			spooled := 0
+			for _, file := range files {
+				data, _ := os.ReadFile(file)
+				spooled += strings.Count(string(data), "\n")
+			}
+			if spooled != tt.wantSpooled {
+				t.Fatalf("spool %d 条, 期望 %d 条", spooled, tt.wantSpooled)
+			}
+		})
+	}
+}
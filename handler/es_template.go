@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	esStatisticalPrefix = "log_push_statistical_data"
+	esBillingPrefix     = "log_push_billing_data"
+	esILMPolicy         = "log_push_retention"
+)
+
+// esTemplateFields 每个索引族的字段类型, start_time/time_local 写入的是秒级时间戳
+var esTemplateFields = map[string]map[string]string{
+	esStatisticalPrefix: {
+		"t": "keyword", "d": "keyword", "c": "keyword", "r": "keyword",
+		"start_time": "date", "time_local": "date", "interval": "long",
+		"bw": "long", "flux": "long", "bs_bw": "long", "bs_flux": "long",
+		"req_num": "long", "hit_num": "long", "bs_num": "long", "bs_fail_num": "long", "hit_flux": "long",
+		"2xx": "long", "3xx": "long", "4xx": "long", "5xx": "long",
+		"b2xx": "long", "b3xx": "long", "b4xx": "long", "b5xx": "long",
+		"bs_duration_ms": "long",
+	},
+	esBillingPrefix: {
+		"t": "keyword", "d": "keyword",
+		"start_time": "date", "time_local": "date", "interval": "long",
+		"bw": "long", "flux": "long",
+	},
+}
+
+// esTemplateBody 旧版 _template 格式, 兼容所有 7.x 版本. 每个月索引自动加入与前缀同名的读别名, 查询统一走别名.
+// 索引按月份命名直接写入, 无法使用 ILM rollover, 这里只用 ILM 做过期删除
+func esTemplateBody(prefix string, retentionDays int) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for field, typ := range esTemplateFields[prefix] {
+		prop := map[string]interface{}{"type": typ}
+		if typ == "date" {
+			prop["format"] = "epoch_second"
+		}
+		properties[field] = prop
+	}
+	settings := map[string]interface{}{
+		"number_of_shards":   envInt("ES_INDEX_SHARDS", 1),
+		"number_of_replicas": os.Getenv("ES_INDEX_REPLICAS"),
+	}
+	if settings["number_of_replicas"] == "" {
+		settings["number_of_replicas"] = 1
+	}
+	if retentionDays > 0 {
+		settings["index.lifecycle.name"] = esILMPolicy
+	}
+	return map[string]interface{}{
+		"index_patterns": []string{prefix + "-*"},
+		"order":          10,
+		"settings":       settings,
+		"aliases":        map[string]interface{}{prefix: map[string]interface{}{}},
+		"mappings": map[string]interface{}{
+			"dynamic":    true,
+			"properties": properties,
+		},
+	}
+}
+
+// StartESBootstrap 启动时安装索引模板和 ILM 策略, ES_BOOTSTRAP=0 时跳过
+func StartESBootstrap() {
+	if os.Getenv("ES_BOOTSTRAP") == "0" || esClient == nil {
+		return
+	}
+	go func() {
+		for attempt := 1; attempt <= defaultRetryPolicy.MaxAttempts; attempt++ {
+			err := bootstrapES(context.Background(), envInt("ES_RETENTION_DAYS", 0))
+			if err == nil {
+				return
+			}
+			log.Printf("### es-bootstrap ### [attempt: %d] 安装索引模板失败: %v\n", attempt, err)
+			time.Sleep(defaultRetryPolicy.Backoff(attempt) + 5*time.Second)
+		}
+	}()
+}
+
+func bootstrapES(ctx context.Context, retentionDays int) error {
+	if retentionDays > 0 {
+		policy := map[string]interface{}{
+			"policy": map[string]interface{}{
+				"phases": map[string]interface{}{
+					"hot": map[string]interface{}{"actions": map[string]interface{}{}},
+					"delete": map[string]interface{}{
+						"min_age": fmt.Sprintf("%dd", retentionDays),
+						"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+					},
+				},
+			},
+		}
+		if _, err := esClient.XPackIlmPutLifecycle().Policy(esILMPolicy).BodyJson(policy).Do(ctx); err != nil {
+			return fmt.Errorf("安装 ILM 策略失败: %v", err)
+		}
+	}
+	for _, prefix := range []string{esStatisticalPrefix, esBillingPrefix} {
+		if _, err := esClient.IndexPutTemplate(prefix).BodyJson(esTemplateBody(prefix, retentionDays)).Do(ctx); err != nil {
+			return fmt.Errorf("安装索引模板 %s 失败: %v", prefix, err)
+		}
+		if err := ensureESReadAlias(ctx, prefix); err != nil {
+			return fmt.Errorf("为已有索引添加别名 %s 失败: %v", prefix, err)
+		}
+	}
+	log.Printf("### es-bootstrap ### 索引模板安装完成, retention: %d 天\n", retentionDays)
+	return nil
+}
+
+// ensureESReadAlias 模板只对新建索引生效, 安装模板前已存在的月索引在这里补上读别名.
+// 迁移未完成的 <index>-v2 与原索引同时存在时跳过, 避免查询重复计数
+func ensureESReadAlias(ctx context.Context, prefix string) error {
+	rows, err := esClient.CatIndices().Index(prefix + "-*").Do(ctx)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		exists[row.Index] = true
+	}
+	alias := esClient.Alias()
+	added := 0
+	for index := range exists {
+		if strings.HasSuffix(index, "-v2") && exists[strings.TrimSuffix(index, "-v2")] {
+			continue
+		}
+		alias = alias.Action(elastic.NewAliasAddAction(prefix).Index(index))
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+	_, err = alias.Do(ctx)
+	return err
+}
+
+// RunESIndices 校验或迁移已存在的月索引
+//
+//	cf_logpush es-indices [-migrate] [-retention 0]
+//
+// 默认只安装模板并列出字段类型与模板不一致的索引; -migrate 时把不一致的索引 reindex 到 <index>-v2,
+// 文档数一致后删除原索引, 并把原索引名作为别名指向新索引, 写入和查询路径不变.
+// 迁移期间原索引设置 index.blocks.write, 写入失败的数据由 bulk 写入器重试或落盘, 迁移完成后写入新索引
+func RunESIndices(args []string) error {
+	fs := flag.NewFlagSet("es-indices", flag.ContinueOnError)
+	migrate := fs.Bool("migrate", false, "迁移字段类型不一致的索引")
+	retention := fs.Int("retention", envInt("ES_RETENTION_DAYS", 0), "ILM 保留天数, 0 表示不删除")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if esClient == nil {
+		return fmt.Errorf("ES 客户端未初始化")
+	}
+	ctx := context.Background()
+	if err := bootstrapES(ctx, *retention); err != nil {
+		return err
+	}
+
+	for _, prefix := range []string{esStatisticalPrefix, esBillingPrefix} {
+		rows, err := esClient.CatIndices().Index(prefix + "-*").Do(ctx)
+		if err != nil {
+			return err
+		}
+		var indices []string
+		for _, row := range rows {
+			indices = append(indices, row.Index)
+		}
+		sort.Strings(indices)
+		for _, index := range indices {
+			if strings.HasSuffix(index, "-v2") {
+				continue
+			}
+			mismatches, err := esMappingMismatches(ctx, index, prefix)
+			if err != nil {
+				return err
+			}
+			if len(mismatches) == 0 {
+				fmt.Printf("[ok] %s\n", index)
+				continue
+			}
+			fmt.Printf("[mismatch] %s: %s\n", index, strings.Join(mismatches, ", "))
+			if *migrate {
+				if err := migrateESIndex(ctx, index, prefix); err != nil {
+					return fmt.Errorf("迁移 %s 失败: %v", index, err)
+				}
+				fmt.Printf("[migrated] %s -> %s-v2\n", index, index)
+			}
+		}
+	}
+	return nil
+}
+
+func esMappingMismatches(ctx context.Context, index, prefix string) ([]string, error) {
+	mapping, err := esClient.GetMapping().Index(index).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	properties := map[string]interface{}{}
+	for _, m := range mapping {
+		if mm, ok := m.(map[string]interface{})["mappings"].(map[string]interface{}); ok {
+			properties, _ = mm["properties"].(map[string]interface{})
+		}
+	}
+	var mismatches []string
+	for field, want := range esTemplateFields[prefix] {
+		prop, ok := properties[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if got, _ := prop["type"].(string); got != want {
+			mismatches = append(mismatches, fmt.Sprintf("%s(%s!=%s)", field, got, want))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches, nil
+}
+
+func migrateESIndex(ctx context.Context, index, prefix string) error {
+	target := index + "-v2"
+	if err := setESWriteBlock(ctx, index, true); err != nil {
+		return err
+	}
+	if err := reindexESIndex(ctx, index, target, prefix); err != nil {
+		if unblockErr := setESWriteBlock(ctx, index, false); unblockErr != nil {
+			log.Printf("### es-indices ### 解除 %s 的写入锁失败: %v\n", index, unblockErr)
+		}
+		return err
+	}
+	// 同一请求内删除原索引并把原索引名和读别名指向新索引, 切换是原子的
+	_, err := esClient.Alias().
+		Action(elastic.NewAliasRemoveIndexAction(index)).
+		Action(elastic.NewAliasAddAction(index).Index(target).IsWriteIndex(true)).
+		Action(elastic.NewAliasAddAction(prefix).Index(target)).
+		Do(ctx)
+	return err
+}
+
+// reindexESIndex 复制到新索引并核对文档数. 新索引按模板创建后先去掉读别名, 复制期间查询不会重复计数
+func reindexESIndex(ctx context.Context, index, target, prefix string) error {
+	exists, err := esClient.IndexExists(target).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := esClient.CreateIndex(target).Do(ctx); err != nil {
+			return err
+		}
+		if _, err := esClient.Alias().Action(elastic.NewAliasRemoveAction(prefix).Index(target)).Do(ctx); err != nil {
+			return err
+		}
+	}
+	if _, err := esClient.Reindex().SourceIndex(index).DestinationIndex(target).Refresh("true").WaitForCompletion(true).Do(ctx); err != nil {
+		return err
+	}
+	src, err := esClient.Count(index).Do(ctx)
+	if err != nil {
+		return err
+	}
+	dst, err := esClient.Count(target).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if src != dst {
+		return fmt.Errorf("文档数不一致: %d != %d, 保留原索引", src, dst)
+	}
+	return nil
+}
+
+func setESWriteBlock(ctx context.Context, index string, block bool) error {
+	_, err := esClient.IndexPutSettings(index).BodyJson(map[string]interface{}{"index.blocks.write": block}).Do(ctx)
+	return err
+}
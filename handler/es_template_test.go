@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// fakeES 记录收到的请求, _count 按索引返回 counts 中的文档数
+type fakeES struct {
+	mu       sync.Mutex
+	requests []string
+	counts   map[string]int
+	indices  []string
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusNotFound)
+	case strings.HasPrefix(path, "_cat/indices"):
+		var rows []string
+		for _, index := range f.indices {
+			rows = append(rows, fmt.Sprintf(`{"index":%q}`, index))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(rows, ","))
+	case strings.HasSuffix(path, "/_count"):
+		fmt.Fprintf(w, `{"count":%d}`, f.counts[strings.TrimSuffix(path, "/_count")])
+	default:
+		w.Write([]byte(`{"acknowledged":true}`))
+	}
+}
+
+func useFakeES(t *testing.T, fake *fakeES) {
+	srv := httptest.NewServer(fake)
+	client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := esClient
+	esClient = client
+	t.Cleanup(func() {
+		esClient = old
+		srv.Close()
+	})
+}
+
+func TestMigrateESIndex(t *testing.T) {
+	const index = esStatisticalPrefix + "-2024-01"
+	tests := []struct {
+		name     string
+		dstCount int
+		wantErr  bool
+		want     []string
+	}{
+		{
+			name:     "文档数一致时切换别名",
+			dstCount: 10,
+			want: []string{
+				`PUT /` + index + `/_settings {"index.blocks.write":true}`,
+				`PUT /` + index + `-v2`,
+				`"remove":{"alias":"` + esStatisticalPrefix + `","index":"` + index + `-v2"}`,
+				`POST /_reindex`,
+				`{"remove_index":{"index":"` + index + `"}}`,
+				`{"add":{"alias":"` + esStatisticalPrefix + `","index":"` + index + `-v2"}}`,
+			},
+		},
+		{
+			name:     "文档数不一致时解除写入锁",
+			dstCount: 9,
+			wantErr:  true,
+			want: []string{
+				`PUT /` + index + `/_settings {"index.blocks.write":true}`,
+				`POST /_reindex`,
+				`PUT /` + index + `/_settings {"index.blocks.write":false}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeES{counts: map[string]int{index: 10, index + "-v2": tt.dstCount}}
+			useFakeES(t, fake)
+
+			err := migrateESIndex(context.Background(), index, esStatisticalPrefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: %v", err)
+			}
+			all := strings.Join(fake.requests, "\n")
+			// 按顺序出现
+			pos := 0
+			for _, want := range tt.want {
+				i := strings.Index(all[pos:], want)
+				if i < 0 {
+					t.Fatalf("缺少或顺序错误 %s, 请求:\n%s", want, all)
+				}
+				pos += i + len(want)
+			}
+			if tt.wantErr && strings.Contains(all, "remove_index") {
+				t.Fatalf("文档数不一致时不应删除原索引:\n%s", all)
+			}
+		})
+	}
+}
+
+func TestEnsureESReadAlias(t *testing.T) {
+	fake := &fakeES{indices: []string{
+		esBillingPrefix + "-2024-01",
+		esBillingPrefix + "-2024-02",
+		esBillingPrefix + "-2024-02-v2",
+	}}
+	useFakeES(t, fake)
+
+	if err := ensureESReadAlias(context.Background(), esBillingPrefix); err != nil {
+		t.Fatal(err)
+	}
+	all := strings.Join(fake.requests, "\n")
+	for _, index := range fake.indices[:2] {
+		if !strings.Contains(all, `"index":"`+index+`"`) {
+			t.Fatalf("%s 未添加别名:\n%s", index, all)
+		}
+	}
+	if strings.Contains(all, `"index":"`+esBillingPrefix+`-2024-02-v2"`) {
+		t.Fatalf("迁移未完成的索引不应加入别名:\n%s", all)
+	}
+}
@@ -18,6 +18,27 @@ func HandleLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, ok := readLogBody(w, r)
+	if !ok {
+		return
+	}
+
+	bodyStr := string(body)
+	lines := strings.Split(bodyStr, "\n")
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		processLogLine(detectDataset(line), line)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// readLogBody 读取 Logpush 请求体, 支持 gzip, 出错时已写入响应
+func readLogBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
 	r.Body = http.MaxBytesReader(w, r.Body, 32<<20)
 	defer r.Body.Close()
 
@@ -27,7 +48,7 @@ func HandleLogs(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("创建 gzip 解压缩器时出错: %v\n", err)
 			http.Error(w, "无法解压缩请求体", http.StatusBadRequest)
-			return
+			return nil, false
 		}
 		defer gzipReader.Close()
 		reader = gzipReader
@@ -37,46 +58,46 @@ func HandleLogs(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("读取请求体时出错: %v\n", err)
 		http.Error(w, "读取请求体时出错", http.StatusBadRequest)
-		return
+		return nil, false
 	}
+	return body, true
+}
 
-	bodyStr := string(body)
-	lines := strings.Split(bodyStr, "\n")
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+func processLogLine(dataset, line string) {
+	if dataset == dto.DatasetHttpRequests {
+		processHTTPRequestLine(line)
+		return
+	}
+	processDatasetLine(dataset, line)
+}
 
-		var inputLog dto.InputLog
-		if err := json.Unmarshal([]byte(line), &inputLog); err != nil {
-			log.Printf("无效的 JSON 数据: %s\n", line)
-			continue
-		}
+func processHTTPRequestLine(line string) {
+	var inputLog dto.InputLog
+	if err := json.Unmarshal([]byte(line), &inputLog); err != nil {
+		log.Printf("无效的 JSON 数据: %s\n", line)
+		return
+	}
 
-		outputLog := TransformLog(inputLog)
+	outputLog := TransformLog(inputLog)
+	recordLogpush(inputLog, outputLog)
 
-		outputJSON, err := json.Marshal(outputLog)
-		if err != nil {
-			log.Printf("序列化输出日志时出错: %v\n", err)
-			continue
-		}
-		if err := SendToTDAgent(string(outputJSON)); err != nil {
-			log.Printf("发送到 td-agent 失败: %v\n", err)
-		}
-		fmt.Println("send success", string(outputJSON))
-		fmt.Println("send success time: ", time.Now().Format(time.DateTime))
-		var inputDownLoadLog dto.InputLogForDownLoad
-		if err := json.Unmarshal([]byte(line), &inputDownLoadLog); err != nil {
-			fmt.Println("HandleLogs json.Unmarshal Err", err.Error())
-			log.Printf("无效的 JSON 数据(离线日志): %s\n", line)
-			continue
-		}
-		WriteToFile(inputDownLoadLog)
+	outputJSON, err := json.Marshal(outputLog)
+	if err != nil {
+		log.Printf("序列化输出日志时出错: %v\n", err)
+		return
 	}
-
-	w.WriteHeader(http.StatusOK)
+	if err := SendToTDAgent(string(outputJSON)); err != nil {
+		log.Printf("发送到 td-agent 失败: %v\n", err)
+	}
+	fmt.Println("send success", string(outputJSON))
+	fmt.Println("send success time: ", time.Now().Format(time.DateTime))
+	var inputDownLoadLog dto.InputLogForDownLoad
+	if err := json.Unmarshal([]byte(line), &inputDownLoadLog); err != nil {
+		fmt.Println("HandleLogs json.Unmarshal Err", err.Error())
+		log.Printf("无效的 JSON 数据(离线日志): %s\n", line)
+		return
+	}
+	WriteToFile(inputDownLoadLog)
 }
 
 func HandleClientLogPush(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	logpushDatasets = map[string]bool{
+		dto.DatasetHttpRequests:       true,
+		dto.DatasetFirewallEvents:     true,
+		dto.DatasetDnsLogs:            true,
+		dto.DatasetSpectrumEvents:     true,
+		dto.DatasetWorkersTraceEvents: true,
+	}
+)
+
+// detectDataset 根据各数据集特有的字段判断日志类型, 无法识别时按 http_requests 处理
+func detectDataset(line string) string {
+	has := func(field string) bool {
+		return strings.Contains(line, `"`+field+`"`)
+	}
+	switch {
+	case has("QueryName") && has("ResponseCode"):
+		return dto.DatasetDnsLogs
+	case has("ScriptName") && has("Outcome"):
+		return dto.DatasetWorkersTraceEvents
+	case has("RuleID") || (has("Action") && has("Source") && has("Kind")):
+		return dto.DatasetFirewallEvents
+	case has("Application") && (has("ConnectTimestamp") || has("OriginProto")):
+		return dto.DatasetSpectrumEvents
+	}
+	return dto.DatasetHttpRequests
+}
+
+// HandleDatasetLogs 按路由指定数据集接收 Logpush: /logpush/{dataset}
+func HandleDatasetLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅支持 POST 方法", http.StatusMethodNotAllowed)
+		return
+	}
+	dataset := strings.Trim(strings.TrimPrefix(r.URL.Path, "/logpush/"), "/")
+	if !logpushDatasets[dataset] {
+		http.Error(w, "不支持的数据集: "+dataset, http.StatusNotFound)
+		return
+	}
+
+	body, ok := readLogBody(w, r)
+	if !ok {
+		return
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		processLogLine(dataset, line)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseDatasetLine 解析非 http_requests 数据集, 返回记录、事件时间和离线文件名中的 key;
+// dns_logs 的 QueryName 取值不可控, 按其建文件会耗尽文件句柄, 因此返回空 key 按数据集写一个文件
+func parseDatasetLine(dataset, line string) (interface{}, time.Time, string, error) {
+	switch dataset {
+	case dto.DatasetFirewallEvents:
+		var e dto.FirewallEvent
+		err := json.Unmarshal([]byte(line), &e)
+		return e, e.Datetime.Time, e.ClientRequestHost, err
+	case dto.DatasetDnsLogs:
+		var e dto.DnsLog
+		err := json.Unmarshal([]byte(line), &e)
+		return e, e.Timestamp.Time, "", err
+	case dto.DatasetSpectrumEvents:
+		var e dto.SpectrumEvent
+		err := json.Unmarshal([]byte(line), &e)
+		t := e.Timestamp.Time
+		if t.IsZero() {
+			t = e.ConnectTimestamp.Time
+		}
+		return e, t, e.Application, err
+	case dto.DatasetWorkersTraceEvents:
+		var e dto.WorkersTraceEvent
+		err := json.Unmarshal([]byte(line), &e)
+		return e, time.UnixMilli(e.EventTimestampMs), e.ScriptName, err
+	}
+	return nil, time.Time{}, "", fmt.Errorf("不支持的数据集: %s", dataset)
+}
+
+func processDatasetLine(dataset, line string) {
+	record, t, key, err := parseDatasetLine(dataset, line)
+	if err != nil {
+		log.Printf("无效的 JSON 数据(%s): %s\n", dataset, line)
+		return
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	outputJSON, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("序列化输出日志时出错(%s): %v\n", dataset, err)
+		return
+	}
+	if err := sendToTDAgentTag("cf."+dataset, string(outputJSON)); err != nil {
+		log.Printf("发送到 td-agent 失败(%s): %v\n", dataset, err)
+	}
+	WriteDatasetToFile(dataset, key, t, string(outputJSON))
+}
@@ -0,0 +1,353 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	queryMaxPoints = 10000
+	queryMaxTopN   = 1000
+	queryAllTenant = "*"
+)
+
+// 对外的指标名 -> ES 字段, bw 按桶内平均带宽返回, 其余求和
+var queryMetricFields = map[string]string{
+	"flux":    "flux",
+	"bw":      "bw",
+	"req_num": "req_num",
+	"hit_num": "hit_num",
+	"2xx":     "2xx",
+	"3xx":     "3xx",
+	"4xx":     "4xx",
+	"5xx":     "5xx",
+}
+
+var queryGranularities = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// queryGroupSizes groupBy 时 terms 分组数上限, 国家按 ISO 3166-1 编码数, 地区按 getRegion 的取值数
+var queryGroupSizes = map[string]int{
+	"country": 256,
+	"region":  16,
+}
+
+var queryGroupFields = map[string]string{
+	"domain":  "d",
+	"country": "c",
+	"region":  "r",
+}
+
+type statsQuery struct {
+	TenantId    string
+	Domain      string
+	Start       time.Time
+	End         time.Time
+	Granularity string
+	Metrics     []string
+	GroupBy     string
+}
+
+type statsPoint map[string]interface{}
+
+type statsSeries struct {
+	Key    string       `json:"key"`
+	Points []statsPoint `json:"points"`
+}
+
+// queryTokens QUERY_TOKENS 格式: token:tenantId,token:tenantId, tenantId 为 * 时可查询任意租户
+func queryTokens() map[string]string {
+	tokens := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv("QUERY_TOKENS"), ",") {
+		token, tenant, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if ok && token != "" && tenant != "" {
+			tokens[token] = tenant
+		}
+	}
+	return tokens
+}
+
+// queryTenant 校验 Bearer token, 返回可查询的租户; 普通 token 只能查自己的租户
+func queryTenant(r *http.Request) (string, int, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	tenant, ok := queryTokens()[token]
+	if token == "" || !ok {
+		return "", http.StatusUnauthorized, fmt.Errorf("未授权")
+	}
+	requested := r.URL.Query().Get("tenantId")
+	if tenant == queryAllTenant {
+		if requested == "" {
+			return "", http.StatusBadRequest, fmt.Errorf("缺少必要参数: tenantId")
+		}
+		return requested, 0, nil
+	}
+	if requested != "" && requested != tenant {
+		return "", http.StatusForbidden, fmt.Errorf("无权查询租户 %s", requested)
+	}
+	return tenant, 0, nil
+}
+
+func parseStatsQuery(r *http.Request, tenant string) (statsQuery, error) {
+	q := r.URL.Query()
+	sq := statsQuery{
+		TenantId:    tenant,
+		Domain:      q.Get("domain"),
+		Granularity: q.Get("granularity"),
+		GroupBy:     q.Get("groupBy"),
+	}
+	start, err := strconv.ParseInt(q.Get("start"), 10, 64)
+	if err != nil {
+		return sq, fmt.Errorf("start 必须为 unix 秒")
+	}
+	end, err := strconv.ParseInt(q.Get("end"), 10, 64)
+	if err != nil || end <= start {
+		return sq, fmt.Errorf("end 必须为 unix 秒且大于 start")
+	}
+	sq.Start, sq.End = time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC()
+	if sq.Granularity == "" {
+		sq.Granularity = "5m"
+	}
+	step, ok := queryGranularities[sq.Granularity]
+	if !ok {
+		return sq, fmt.Errorf("granularity 取值: 1m, 5m, 1h, 1d")
+	}
+	metrics := q.Get("metrics")
+	if metrics == "" {
+		metrics = "flux,bw,req_num"
+	}
+	for _, m := range strings.Split(metrics, ",") {
+		if _, ok := queryMetricFields[m]; !ok {
+			return sq, fmt.Errorf("不支持的指标: %s", m)
+		}
+		sq.Metrics = append(sq.Metrics, m)
+	}
+	if sq.GroupBy != "" && sq.GroupBy != "country" && sq.GroupBy != "region" {
+		return sq, fmt.Errorf("groupBy 取值: country, region")
+	}
+	// ES 单次查询的桶数受 search.max_buckets 限制, groupBy 时每个分组都有一组时间点, 点数上限按分组数均分
+	maxPoints := int64(queryMaxPoints)
+	if sq.GroupBy != "" {
+		maxPoints = maxPoints/int64(queryGroupSizes[sq.GroupBy]) - 1
+	}
+	if int64(sq.End.Sub(sq.Start)/step)+1 > maxPoints {
+		return sq, fmt.Errorf("时间范围过大, 最多 %d 个点", maxPoints)
+	}
+	return sq, nil
+}
+
+func (sq statsQuery) filter() *elastic.BoolQuery {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("t", sq.TenantId),
+		elastic.NewRangeQuery("start_time").Gte(sq.Start.Unix()).Lt(sq.End.Unix()).Format("epoch_second"),
+	)
+	if sq.Domain != "" {
+		query = query.Filter(elastic.NewTermQuery("d", sq.Domain))
+	}
+	return query
+}
+
+// queryBWScript bw 按记录粒度加权, 除以桶长度得到平均带宽; 没有 interval 字段的旧数据按 60 秒处理
+const queryBWScript = "doc['bw'].value * (doc['interval'].size() == 0 || doc['interval'].value == 0 ? 60 : doc['interval'].value)"
+
+func metricAgg(m string) elastic.Aggregation {
+	if m == "bw" {
+		return elastic.NewSumAggregation().Script(elastic.NewScript(queryBWScript))
+	}
+	return elastic.NewSumAggregation().Field(queryMetricFields[m])
+}
+
+// queryTimeSeries 按 granularity 做 date_histogram, groupBy 时外层再按国家/地区 terms 分组
+func queryTimeSeries(ctx context.Context, sq statsQuery) ([]statsSeries, error) {
+	step := queryGranularities[sq.Granularity]
+	histogram := elastic.NewDateHistogramAggregation().Field("start_time").FixedInterval(sq.Granularity).
+		MinDocCount(0).ExtendedBounds(sq.Start.Unix()*1000, sq.End.Unix()*1000-1)
+	for _, m := range sq.Metrics {
+		histogram = histogram.SubAggregation(m, metricAgg(m))
+	}
+
+	search := esClient.Search(esStatisticalPrefix).IgnoreUnavailable(true).Query(sq.filter()).Size(0)
+	if sq.GroupBy != "" {
+		search = search.Aggregation("group", elastic.NewTermsAggregation().Field(queryGroupFields[sq.GroupBy]).
+			Size(queryGroupSizes[sq.GroupBy]).SubAggregation("ts", histogram))
+	} else {
+		search = search.Aggregation("ts", histogram)
+	}
+	res, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if sq.GroupBy == "" {
+		hist, ok := res.Aggregations.DateHistogram("ts")
+		if !ok {
+			return []statsSeries{}, nil
+		}
+		return []statsSeries{{Key: "all", Points: histogramPoints(hist, sq.Metrics, step)}}, nil
+	}
+	terms, ok := res.Aggregations.Terms("group")
+	if !ok {
+		return []statsSeries{}, nil
+	}
+	series := []statsSeries{}
+	for _, bucket := range terms.Buckets {
+		hist, ok := bucket.DateHistogram("ts")
+		if !ok {
+			continue
+		}
+		series = append(series, statsSeries{Key: fmt.Sprint(bucket.Key), Points: histogramPoints(hist, sq.Metrics, step)})
+	}
+	return series, nil
+}
+
+func histogramPoints(hist *elastic.AggregationBucketHistogramItems, metrics []string, step time.Duration) []statsPoint {
+	points := make([]statsPoint, 0, len(hist.Buckets))
+	for _, bucket := range hist.Buckets {
+		point := statsPoint{"time": int64(bucket.Key) / 1000}
+		for _, m := range metrics {
+			point[m] = metricValue(bucket.Aggregations, m, step)
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// metricValue bw 的聚合值为 带宽*粒度 之和, 除以桶长度 (秒) 得到平均带宽
+func metricValue(aggs elastic.Aggregations, m string, step time.Duration) int64 {
+	sum, ok := aggs.Sum(m)
+	if !ok || sum.Value == nil {
+		return 0
+	}
+	if m == "bw" {
+		return int64(*sum.Value / step.Seconds())
+	}
+	return int64(*sum.Value)
+}
+
+// queryTopN 按 by 分组, 以 metric 总量倒序返回前 size 个
+func queryTopN(ctx context.Context, sq statsQuery, by, metric string, size int) ([]statsPoint, error) {
+	terms := elastic.NewTermsAggregation().Field(queryGroupFields[by]).Size(size).
+		OrderByAggregation(metric, false)
+	for _, m := range sq.Metrics {
+		terms = terms.SubAggregation(m, metricAgg(m))
+	}
+	if !containsString(sq.Metrics, metric) {
+		terms = terms.SubAggregation(metric, metricAgg(metric))
+	}
+	res, err := esClient.Search(esStatisticalPrefix).IgnoreUnavailable(true).Query(sq.filter()).Size(0).Aggregation("top", terms).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	top := []statsPoint{}
+	result, ok := res.Aggregations.Terms("top")
+	if !ok {
+		return top, nil
+	}
+	span := sq.End.Sub(sq.Start)
+	for _, bucket := range result.Buckets {
+		point := statsPoint{"key": fmt.Sprint(bucket.Key)}
+		for _, m := range sq.Metrics {
+			point[m] = metricValue(bucket.Aggregations, m, span)
+		}
+		top = append(top, point)
+	}
+	return top, nil
+}
+
+// HandleQueryTimeSeries GET /v2/query/timeseries?start=&end=&granularity=&metrics=&domain=&groupBy=&tenantId=
+func HandleQueryTimeSeries(w http.ResponseWriter, r *http.Request) {
+	sq, ok := parseQueryRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	series, err := queryTimeSeries(ctx, sq)
+	if err != nil {
+		writeJobResponse(w, http.StatusInternalServerError, "查询 ES 失败: "+err.Error())
+		return
+	}
+	writeJobResponse(w, http.StatusOK, map[string]interface{}{
+		"tenantId":    sq.TenantId,
+		"domain":      sq.Domain,
+		"granularity": sq.Granularity,
+		"series":      series,
+	})
+}
+
+// HandleQueryTop GET /v2/query/top?start=&end=&by=domain|country|region&metric=flux&size=10&metrics=&domain=&tenantId=
+func HandleQueryTop(w http.ResponseWriter, r *http.Request) {
+	sq, ok := parseQueryRequest(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	by := q.Get("by")
+	if by == "" {
+		by = "domain"
+	}
+	if _, ok := queryGroupFields[by]; !ok {
+		writeJobResponse(w, http.StatusBadRequest, "by 取值: domain, country, region")
+		return
+	}
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "flux"
+	}
+	if _, ok := queryMetricFields[metric]; !ok {
+		writeJobResponse(w, http.StatusBadRequest, "不支持的指标: "+metric)
+		return
+	}
+	size, err := strconv.Atoi(q.Get("size"))
+	if err != nil || size <= 0 {
+		size = 10
+	}
+	if size > queryMaxTopN {
+		size = queryMaxTopN
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	top, err := queryTopN(ctx, sq, by, metric, size)
+	if err != nil {
+		writeJobResponse(w, http.StatusInternalServerError, "查询 ES 失败: "+err.Error())
+		return
+	}
+	writeJobResponse(w, http.StatusOK, map[string]interface{}{
+		"tenantId": sq.TenantId,
+		"by":       by,
+		"metric":   metric,
+		"top":      top,
+	})
+}
+
+func parseQueryRequest(w http.ResponseWriter, r *http.Request) (statsQuery, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅支持 GET 方法", http.StatusMethodNotAllowed)
+		return statsQuery{}, false
+	}
+	tenant, code, err := queryTenant(r)
+	if err != nil {
+		writeJobResponse(w, code, err.Error())
+		return statsQuery{}, false
+	}
+	sq, err := parseStatsQuery(r, tenant)
+	if err != nil {
+		writeJobResponse(w, http.StatusBadRequest, err.Error())
+		return statsQuery{}, false
+	}
+	if esClient == nil {
+		writeJobResponse(w, http.StatusServiceUnavailable, "ES 客户端未初始化")
+		return statsQuery{}, false
+	}
+	return sq, true
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+func TestParseStatsQueryMaxPoints(t *testing.T) {
+	// 点数上限: 不分组 10000; 按国家 10000/256-1 = 38; 按地区 10000/16-1 = 624. 点数为 范围/粒度 + 1
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{name: "不分组 10000 个点", query: "granularity=1m&end=599940"},
+		{name: "不分组 10001 个点", query: "granularity=1m&end=600000", wantErr: true},
+		{name: "按地区 624 个点", query: "granularity=1m&end=37380&groupBy=region"},
+		{name: "按地区 625 个点", query: "granularity=1m&end=37440&groupBy=region", wantErr: true},
+		{name: "按国家 38 个点", query: "granularity=1h&end=133200&groupBy=country"},
+		{name: "按国家 39 个点", query: "granularity=1h&end=136800&groupBy=country", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/query/timeseries?start=0&%s", tt.query), nil)
+			_, err := parseStatsQuery(r, "t1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryTimeSeriesBW(t *testing.T) {
+	// 固定数据: 一个 5 分钟桶内有 1 分钟粒度 bw=100 和 5 分钟粒度 bw=50 两条记录,
+	// 按粒度加权的和为 100*60 + 50*300 = 21000, 平均带宽 21000/300 = 70
+	const bucket = `{"key":1704067200000,"doc_count":2,"bw":{"value":21000},"flux":{"value":1500}}`
+	tests := []struct {
+		name        string
+		groupBy     string
+		response    string
+		wantRequest []string
+		wantKey     string
+	}{
+		{
+			name:        "不分组",
+			response:    `{"ts":{"buckets":[` + bucket + `]}}`,
+			wantRequest: []string{`"fixed_interval":"5m"`, `doc['bw'].value * (doc['interval'].size() == 0 || doc['interval'].value == 0 ? 60 : doc['interval'].value)`},
+			wantKey:     "all",
+		},
+		{
+			name:        "按地区分组",
+			groupBy:     "region",
+			response:    `{"group":{"buckets":[{"key":"asia","doc_count":2,"ts":{"buckets":[` + bucket + `]}}]}}`,
+			wantRequest: []string{`"field":"r","size":16`},
+			wantKey:     "asia",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				request = string(body)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"hits":{"total":{"value":2}},"aggregations":%s}`, tt.response)
+			}))
+			defer srv.Close()
+			client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := esClient
+			esClient = client
+			defer func() { esClient = old }()
+
+			start := time.Unix(1704067200, 0).UTC()
+			series, err := queryTimeSeries(context.Background(), statsQuery{TenantId: "t1", Start: start, End: start.Add(5 * time.Minute),
+				Granularity: "5m", Metrics: []string{"bw", "flux"}, GroupBy: tt.groupBy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.wantRequest {
+				if !strings.Contains(request, want) {
+					t.Fatalf("查询中缺少 %s: %s", want, request)
+				}
+			}
+			if len(series) != 1 || series[0].Key != tt.wantKey || len(series[0].Points) != 1 {
+				t.Fatalf("返回 %+v", series)
+			}
+			if p := series[0].Points[0]; p["bw"] != int64(70) || p["flux"] != int64(1500) || p["time"] != int64(1704067200) {
+				t.Fatalf("点 %v, 期望 bw=70 flux=1500", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,484 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reconcileRetention = 48 * time.Hour
+	reconcileMaxChunk  = time.Hour
+)
+
+var (
+	cfReconcileQuery = cfZoneQuery{
+		Dataset:    CFDatasetHttpRequestsAdaptiveGroups,
+		Dimensions: []string{"datetimeMinute", "clientRequestHTTPHost"},
+		Sums:       []string{"edgeResponseBytes"},
+		OrderBy:    []string{"datetimeMinute_ASC"},
+		Count:      true,
+		Limit:      cfGraphQLMaxLimit,
+	}
+
+	logpushCounters = &reconcileCounterStore{counters: make(map[reconcileKey]*reconcileCounter)}
+
+	reconcileRuns         = expvar.NewInt("reconcile_runs")
+	reconcileGapMinutes   = expvar.NewMap("reconcile_gap_minutes")
+	reconcileMissingReqs  = expvar.NewMap("reconcile_missing_requests")
+	logpushReceivedLines  = expvar.NewInt("logpush_received_lines")
+	reconcileLastReportMu sync.RWMutex
+	reconcileLastReports  = make(map[string]*reconcileReport)
+	reconcileOnce         sync.Once
+)
+
+type reconcileKey struct {
+	Domain string
+	Minute int64
+}
+
+type reconcileCounter struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// reconcileCounterStore 按 域名+分钟 统计 Logpush 实际收到的请求数和字节数
+type reconcileCounterStore struct {
+	mu       sync.Mutex
+	counters map[reconcileKey]*reconcileCounter
+}
+
+func (s *reconcileCounterStore) Add(domain string, t time.Time, bytes int64) {
+	key := reconcileKey{Domain: strings.ToLower(domain), Minute: t.UTC().Truncate(time.Minute).Unix()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[key]
+	if !ok {
+		c = &reconcileCounter{}
+		s.counters[key] = c
+	}
+	c.Requests++
+	c.Bytes += bytes
+}
+
+func (s *reconcileCounterStore) Range(start, end time.Time) map[reconcileKey]reconcileCounter {
+	res := make(map[reconcileKey]reconcileCounter)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, c := range s.counters {
+		if k.Minute >= start.Unix() && k.Minute < end.Unix() {
+			res[k] = *c
+		}
+	}
+	return res
+}
+
+func (s *reconcileCounterStore) prune(before time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.counters {
+		if k.Minute < before.Unix() {
+			delete(s.counters, k)
+		}
+	}
+}
+
+type reconcileSnapshotItem struct {
+	Domain string `json:"domain"`
+	Minute int64  `json:"minute"`
+	reconcileCounter
+}
+
+func (s *reconcileCounterStore) save(path string) error {
+	s.mu.Lock()
+	items := make([]reconcileSnapshotItem, 0, len(s.counters))
+	for k, c := range s.counters {
+		items = append(items, reconcileSnapshotItem{Domain: k.Domain, Minute: k.Minute, reconcileCounter: *c})
+	}
+	s.mu.Unlock()
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, fileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *reconcileCounterStore) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items []reconcileSnapshotItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range items {
+		c := item.reconcileCounter
+		s.counters[reconcileKey{Domain: item.Domain, Minute: item.Minute}] = &c
+	}
+	return nil
+}
+
+// recordLogpush 在 HandleLogs 中调用, 记录一条 Logpush 请求;
+// GraphQL 的 datetimeMinute 按请求开始时间分桶, 这里同样按 EdgeStartTimestamp 计数, 而不是 out.StartTime (EdgeEndTimestamp)
+func recordLogpush(input dto.InputLog, out dto.OutputLog) {
+	logpushReceivedLines.Add(1)
+	t, err := time.Parse(time.RFC3339, input.EdgeStartTimestamp)
+	if err != nil || out.Domain == "" {
+		return
+	}
+	logpushCounters.Add(out.Domain, t, int64(out.Flux))
+}
+
+type reconcileMinuteGap struct {
+	Domain          string  `json:"domain"`
+	Minute          string  `json:"minute"`
+	GraphQLRequests int64   `json:"graphql_requests"`
+	LogpushRequests int64   `json:"logpush_requests"`
+	GraphQLBytes    int64   `json:"graphql_bytes"`
+	LogpushBytes    int64   `json:"logpush_bytes"`
+	MissingRatio    float64 `json:"missing_ratio"`
+}
+
+type reconcileDomainTotal struct {
+	Domain          string  `json:"domain"`
+	GraphQLRequests int64   `json:"graphql_requests"`
+	LogpushRequests int64   `json:"logpush_requests"`
+	GraphQLBytes    int64   `json:"graphql_bytes"`
+	LogpushBytes    int64   `json:"logpush_bytes"`
+	MissingRatio    float64 `json:"missing_ratio"`
+	GapMinutes      int     `json:"gap_minutes"`
+}
+
+type reconcileReport struct {
+	Zone        string                 `json:"zone"`
+	StartTime   string                 `json:"start_time"`
+	EndTime     string                 `json:"end_time"`
+	Threshold   float64                `json:"threshold"`
+	GeneratedAt string                 `json:"generated_at"`
+	Complete    bool                   `json:"complete"`
+	Domains     []reconcileDomainTotal `json:"domains"`
+	Gaps        []reconcileMinuteGap   `json:"gaps"`
+}
+
+type reconcileConfig struct {
+	Zones       []string
+	Interval    time.Duration
+	Lag         time.Duration
+	Threshold   float64
+	MinRequests int64
+	StateDir    string
+}
+
+func loadReconcileConfig() reconcileConfig {
+	conf := reconcileConfig{
+		Interval:    envMinutes("CF_RECONCILE_INTERVAL_MIN", 30),
+		Lag:         envMinutes("CF_RECONCILE_LAG_MIN", 10),
+		Threshold:   0.05,
+		MinRequests: int64(envInt("CF_RECONCILE_MIN_REQUESTS", 50)),
+		StateDir:    os.Getenv("CF_RECONCILE_STATE_DIR"),
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("CF_RECONCILE_THRESHOLD"), 64); err == nil && v > 0 {
+		conf.Threshold = v
+	}
+	for _, zone := range strings.Split(os.Getenv("CF_RECONCILE_ZONES"), ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			conf.Zones = append(conf.Zones, zone)
+		}
+	}
+	if conf.StateDir == "" {
+		conf.StateDir = filepath.Join(dto.LogPath, ".reconcile")
+	}
+	return conf
+}
+
+// StartReconciler 加载/定时保存 Logpush 计数, 配置了 CF_RECONCILE_ZONES 时定时对账
+func StartReconciler() {
+	reconcileOnce.Do(func() {
+		conf := loadReconcileConfig()
+		if err := os.MkdirAll(conf.StateDir, os.ModePerm); err != nil {
+			log.Printf("### reconcile ### 创建状态目录失败: %v\n", err)
+			return
+		}
+		snapshot := filepath.Join(conf.StateDir, "logpush_counters.json")
+		if err := logpushCounters.load(snapshot); err != nil {
+			log.Printf("### reconcile ### 加载 Logpush 计数失败: %v\n", err)
+		}
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				logpushCounters.prune(time.Now().Add(-reconcileRetention))
+				if err := logpushCounters.save(snapshot); err != nil {
+					log.Printf("### reconcile ### 保存 Logpush 计数失败: %v\n", err)
+				}
+			}
+		}()
+
+		if len(conf.Zones) == 0 {
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(conf.Interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				end := time.Now().UTC().Add(-conf.Lag).Truncate(time.Minute)
+				start := end.Add(-conf.Interval)
+				for _, zone := range conf.Zones {
+					if _, err := runReconcile(context.Background(), conf, zone, start, end); err != nil {
+						log.Printf("### reconcile ### [zoneId: %s] 对账失败: %v\n", zone, err)
+					}
+				}
+			}
+		}()
+	})
+}
+
+func queryReconcileTotals(ctx context.Context, zone string, start, end time.Time) (map[reconcileKey]reconcileCounter, error) {
+	query, err := cfReconcileQuery.Build()
+	if err != nil {
+		return nil, err
+	}
+	type reconcileGroup struct {
+		Count      int64 `json:"count"`
+		Dimensions struct {
+			DatetimeMinute        string `json:"datetimeMinute"`
+			ClientRequestHTTPHost string `json:"clientRequestHTTPHost"`
+		} `json:"dimensions"`
+		Sum struct {
+			EdgeResponseBytes int64 `json:"edgeResponseBytes"`
+		} `json:"sum"`
+	}
+	res := make(map[reconcileKey]reconcileCounter)
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(reconcileMaxChunk) {
+		chunkEnd := chunkStart.Add(reconcileMaxChunk)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		// 分组数达到上限时 cfQueryWindow 会拆分窗口, 避免结果被静默截断
+		groups, err := cfQueryWindow(ctx, chunkStart, chunkEnd, cfReconcileQuery.limit(), func(ctx context.Context, start, end time.Time) ([]reconcileGroup, error) {
+			var data struct {
+				Viewer struct {
+					Zones []struct {
+						Groups []reconcileGroup `json:"httpRequestsAdaptiveGroups"`
+					} `json:"zones"`
+				} `json:"viewer"`
+			}
+			variables := map[string]interface{}{
+				"zoneTag": zone,
+				"filter": map[string]interface{}{
+					"datetime_geq": start.Format(time.RFC3339),
+					"datetime_lt":  end.Format(time.RFC3339),
+				},
+			}
+			if err := cfClient.Do(ctx, query, variables, &data); err != nil {
+				return nil, err
+			}
+			var groups []reconcileGroup
+			for _, z := range data.Viewer.Zones {
+				groups = append(groups, z.Groups...)
+			}
+			return groups, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			t, err := time.Parse(time.RFC3339, g.Dimensions.DatetimeMinute)
+			if err != nil {
+				continue
+			}
+			key := reconcileKey{Domain: strings.ToLower(g.Dimensions.ClientRequestHTTPHost), Minute: t.Unix()}
+			c := res[key]
+			c.Requests += g.Count
+			c.Bytes += g.Sum.EdgeResponseBytes
+			res[key] = c
+		}
+	}
+	return res, nil
+}
+
+func missingRatio(expected, actual int64) float64 {
+	if expected <= 0 || actual >= expected {
+		return 0
+	}
+	return float64(expected-actual) / float64(expected)
+}
+
+// runReconcile 对比 GraphQL 聚合与 Logpush 实收数据, GraphQL 为抽样估算值, 请求数过小的分钟不判定缺口
+func runReconcile(ctx context.Context, conf reconcileConfig, zone string, start, end time.Time) (*reconcileReport, error) {
+	graphql, err := queryReconcileTotals(ctx, zone, start, end)
+	if err != nil {
+		return nil, err
+	}
+	logpush := logpushCounters.Range(start, end)
+
+	domains := make(map[string]*reconcileDomainTotal)
+	domainOf := func(name string) *reconcileDomainTotal {
+		d, ok := domains[name]
+		if !ok {
+			d = &reconcileDomainTotal{Domain: name}
+			domains[name] = d
+		}
+		return d
+	}
+	report := &reconcileReport{
+		Zone:        zone,
+		StartTime:   start.Format(time.RFC3339),
+		EndTime:     end.Format(time.RFC3339),
+		Threshold:   conf.Threshold,
+		GeneratedAt: time.Now().Format(time.RFC3339),
+		Complete:    true,
+		Gaps:        []reconcileMinuteGap{},
+	}
+	for key, gq := range graphql {
+		lp := logpush[key]
+		d := domainOf(key.Domain)
+		d.GraphQLRequests += gq.Requests
+		d.GraphQLBytes += gq.Bytes
+		d.LogpushRequests += lp.Requests
+		d.LogpushBytes += lp.Bytes
+
+		ratio := missingRatio(gq.Requests, lp.Requests)
+		if gq.Requests >= conf.MinRequests && ratio > conf.Threshold {
+			d.GapMinutes++
+			report.Gaps = append(report.Gaps, reconcileMinuteGap{
+				Domain:          key.Domain,
+				Minute:          time.Unix(key.Minute, 0).UTC().Format(time.RFC3339),
+				GraphQLRequests: gq.Requests,
+				LogpushRequests: lp.Requests,
+				GraphQLBytes:    gq.Bytes,
+				LogpushBytes:    lp.Bytes,
+				MissingRatio:    ratio,
+			})
+		}
+	}
+
+	for _, d := range domains {
+		d.MissingRatio = missingRatio(d.GraphQLRequests, d.LogpushRequests)
+		if d.GapMinutes > 0 || (d.GraphQLRequests >= conf.MinRequests && d.MissingRatio > conf.Threshold) {
+			report.Complete = false
+		}
+		reconcileGapMinutes.Add(d.Domain, int64(d.GapMinutes))
+		reconcileMissingReqs.Add(d.Domain, max(d.GraphQLRequests-d.LogpushRequests, 0))
+		report.Domains = append(report.Domains, *d)
+	}
+	sort.Slice(report.Domains, func(i, j int) bool { return report.Domains[i].Domain < report.Domains[j].Domain })
+	sort.Slice(report.Gaps, func(i, j int) bool {
+		if report.Gaps[i].Minute != report.Gaps[j].Minute {
+			return report.Gaps[i].Minute < report.Gaps[j].Minute
+		}
+		return report.Gaps[i].Domain < report.Gaps[j].Domain
+	})
+	reconcileRuns.Add(1)
+
+	reconcileLastReportMu.Lock()
+	reconcileLastReports[zone] = report
+	reconcileLastReportMu.Unlock()
+	if !report.Complete {
+		fmt.Println("### reconcile ###", "[zoneId: "+zone+"] [startTime: "+report.StartTime+"] [endTime: "+report.EndTime+"]", fmt.Sprintf("[gaps: %d]", len(report.Gaps)))
+	}
+	return report, nil
+}
+
+// reconcileZoneAllowed 与 /v2/query 共用 QUERY_TOKENS 鉴权, 租户 token 只能访问 CF_POLL_ZONES 中属于自己的 zone
+func reconcileZoneAllowed(r *http.Request) (func(zone string) bool, int, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	tenant, ok := queryTokens()[token]
+	if token == "" || !ok {
+		return nil, http.StatusUnauthorized, fmt.Errorf("未授权")
+	}
+	zones := loadCFPollerConfig().Zones
+	return func(zone string) bool {
+		return tenant == queryAllTenant || zones[zone] == tenant
+	}, 0, nil
+}
+
+// HandleReconcile 按需对账: GET /cloudFlare/reconcile?zoneId=&startTime=&endTime=[&threshold=]
+// 不带时间参数时返回各 zone 最近一次的对账报告; 需要 Authorization: Bearer <QUERY_TOKENS 中的 token>
+func HandleReconcile(w http.ResponseWriter, r *http.Request) {
+	zoneId := r.URL.Query().Get("zoneId")
+	startTimeStr := r.URL.Query().Get("startTime")
+	endTimeStr := r.URL.Query().Get("endTime")
+
+	allowed, code, err := reconcileZoneAllowed(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if zoneId != "" && !allowed(zoneId) {
+		http.Error(w, "无权访问 zone "+zoneId, http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if startTimeStr == "" && endTimeStr == "" {
+		reconcileLastReportMu.RLock()
+		defer reconcileLastReportMu.RUnlock()
+		if zoneId != "" {
+			json.NewEncoder(w).Encode(reconcileLastReports[zoneId])
+			return
+		}
+		reports := make(map[string]*reconcileReport)
+		for zone, report := range reconcileLastReports {
+			if allowed(zone) {
+				reports[zone] = report
+			}
+		}
+		json.NewEncoder(w).Encode(reports)
+		return
+	}
+
+	if zoneId == "" || startTimeStr == "" || endTimeStr == "" {
+		http.Error(w, "缺少必要参数: zoneId, startTime, endTime", http.StatusBadRequest)
+		return
+	}
+	startTimeUnix, err := strconv.ParseInt(startTimeStr, 10, 64)
+	if err != nil {
+		http.Error(w, "无效的开始时间格式", http.StatusBadRequest)
+		return
+	}
+	endTimeUnix, err := strconv.ParseInt(endTimeStr, 10, 64)
+	if err != nil || endTimeUnix <= startTimeUnix {
+		http.Error(w, "无效的结束时间格式", http.StatusBadRequest)
+		return
+	}
+	conf := loadReconcileConfig()
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 {
+			http.Error(w, "无效的 threshold", http.StatusBadRequest)
+			return
+		}
+		conf.Threshold = threshold
+	}
+
+	start := time.Unix(startTimeUnix, 0).UTC().Truncate(time.Minute)
+	end := time.Unix(endTimeUnix, 0).UTC().Truncate(time.Minute)
+	report, err := runReconcile(r.Context(), conf, zoneId, start, end)
+	if err != nil {
+		http.Error(w, "对账失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
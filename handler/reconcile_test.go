@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleReconcileAuth(t *testing.T) {
+	t.Setenv("QUERY_TOKENS", "admin:*,tok1:t1")
+	t.Setenv("CF_POLL_ZONES", "z1:t1,z2:t2")
+	reconcileLastReportMu.Lock()
+	old := reconcileLastReports
+	reconcileLastReports = map[string]*reconcileReport{"z1": {Zone: "z1"}, "z2": {Zone: "z2"}}
+	reconcileLastReportMu.Unlock()
+	defer func() {
+		reconcileLastReportMu.Lock()
+		reconcileLastReports = old
+		reconcileLastReportMu.Unlock()
+	}()
+
+	tests := []struct {
+		name      string
+		token     string
+		query     string
+		wantCode  int
+		wantZones int
+	}{
+		{name: "没有 token", query: "zoneId=z1&startTime=0&endTime=60", wantCode: http.StatusUnauthorized},
+		{name: "未知 token", token: "bad", wantCode: http.StatusUnauthorized},
+		{name: "租户 token 不能对账其他租户的 zone", token: "tok1", query: "zoneId=z2&startTime=0&endTime=60", wantCode: http.StatusForbidden},
+		{name: "租户 token 只能看到自己的报告", token: "tok1", wantCode: http.StatusOK, wantZones: 1},
+		{name: "管理 token 可以看到所有报告", token: "admin", wantCode: http.StatusOK, wantZones: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/cloudFlare/reconcile?"+tt.query, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			HandleReconcile(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("状态码 %d, 期望 %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var reports map[string]*reconcileReport
+			if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil || len(reports) != tt.wantZones {
+				t.Fatalf("返回 %s", w.Body.String())
+			}
+		})
+	}
+}
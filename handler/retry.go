@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errCircuitOpen = errors.New("熔断器已打开, 暂停请求")
+
+	// Cloudflare GraphQL 配额为每个用户 5 分钟 300 次查询
+	cfGraphQLRate  = 1.0
+	cfGraphQLBurst = 10
+
+	accountLimiters sync.Map
+)
+
+type retryPolicy struct {
+	MaxAttempts   int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	MaxRetryAfter time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	MaxAttempts:   4,
+	BaseDelay:     500 * time.Millisecond,
+	MaxDelay:      30 * time.Second,
+	MaxRetryAfter: 5 * time.Minute,
+}
+
+// Backoff 指数退避 + full jitter, attempt 从 1 开始
+func (p retryPolicy) Backoff(attempt int) time.Duration {
+	d := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	return time.Duration(rand.Float64() * d)
+}
+
+// sleepCtx 等待 d, ctx 结束时提前返回
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// parseRetryAfter 支持秒数和 HTTP-date 两种格式
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait 阻塞直到拿到一个令牌
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		if err := sleepCtx(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// accountLimiter 按账号(凭证)共享令牌桶
+func accountLimiter(account string, rate float64, burst int) *tokenBucket {
+	v, _ := accountLimiters.LoadOrStore(account, newTokenBucket(rate, burst))
+	return v.(*tokenBucket)
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow 熔断打开期间拒绝请求, 冷却结束后放行(半开), 再次失败会立即重新打开
+func (cb *circuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if time.Now().Before(cb.openUntil) {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+func (cb *circuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+	cb.openUntil = time.Time{}
+}
+
+func (cb *circuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+// retryHTTPClient 项目内所有对外 HTTP 请求共用的重试客户端:
+// 网络错误、429 和 5xx 自动重试, 遵循 Retry-After, 可选限流和熔断
+type retryHTTPClient struct {
+	name    string
+	client  *http.Client
+	policy  retryPolicy
+	limiter *tokenBucket
+	breaker *circuitBreaker
+}
+
+func newRetryHTTPClient(name string, timeout time.Duration, policy retryPolicy, limiter *tokenBucket) *retryHTTPClient {
+	return &retryHTTPClient{
+		name:    name,
+		client:  &http.Client{Timeout: timeout},
+		policy:  policy,
+		limiter: limiter,
+		breaker: newCircuitBreaker(5, 30*time.Second),
+	}
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Do 有请求体时必须可重放(http.NewRequest 对 bytes/strings Reader 会设置 GetBody)
+func (c *retryHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var lastErr error
+	for attempt := 1; attempt <= c.policy.MaxAttempts; attempt++ {
+		if err := c.breaker.Allow(); err != nil {
+			return nil, fmt.Errorf("### %s ### %w", c.name, err)
+		}
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		attemptReq := req
+		if attempt > 1 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, lastErr
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		delay := c.policy.Backoff(attempt)
+		resp, err := c.client.Do(attemptReq)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			c.breaker.Failure()
+			lastErr = err
+		case isRetryableStatus(resp.StatusCode):
+			if resp.StatusCode >= 500 {
+				c.breaker.Failure()
+			}
+			if ra, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if ra > c.policy.MaxRetryAfter {
+					ra = c.policy.MaxRetryAfter
+				}
+				if ra > delay {
+					delay = ra
+				}
+			}
+			if attempt == c.policy.MaxAttempts {
+				return resp, nil
+			}
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("返回状态码 %d: %s", resp.StatusCode, string(body))
+		default:
+			c.breaker.Success()
+			return resp, nil
+		}
+
+		if attempt < c.policy.MaxAttempts {
+			log.Printf("### %s ### 尝试 %d 失败: %v, 等待 %v 后重试\n", c.name, attempt, lastErr, delay)
+			if err := sleepCtx(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("### %s ### 所有 %d 次尝试均失败: %w", c.name, c.policy.MaxAttempts, lastErr)
+}
+
+// RoundTrip 作为 ES 和腾讯云 SDK 的 Transport, 让 SDK 发出的请求同样重试和熔断;
+// SDK 构造的请求不一定设置 GetBody, 先把请求体读入内存使其可重放
+func (c *retryHTTPClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return c.Do(req)
+}
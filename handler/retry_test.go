@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+func TestRetryHTTPClientRoundTrip(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// 第一次返回 503, 重试时请求体必须完整重发
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/x/_count" && strings.Contains(string(body), `"term"`) {
+			w.Write([]byte(`{"count":7}`))
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+	transport := newRetryHTTPClient("round-trip-test", 0, retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}, nil)
+
+	t.Run("请求体没有 GetBody 时也能重放", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, io.NopCloser(strings.NewReader("payload")))
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "payload" || atomic.LoadInt32(&calls) != 2 {
+			t.Fatalf("返回 %q, 请求 %d 次", body, calls)
+		}
+	})
+
+	t.Run("ES 客户端通过共用 Transport 重试", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false),
+			elastic.SetHttpClient(&http.Client{Transport: transport}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 测试服务只在收到完整查询体时返回 count
+		count, err := client.Count("x").Query(elastic.NewTermQuery("n", 7)).Do(context.Background())
+		if err != nil || count != 7 || atomic.LoadInt32(&calls) != 2 {
+			t.Fatalf("count %d err %v, 请求 %d 次", count, err, calls)
+		}
+	})
+}
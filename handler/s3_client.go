@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client 兼容 S3 协议的最小客户端 (R2 / MinIO / AWS S3), 使用 path-style 地址和 SigV4 签名
+type s3Client struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	http      *retryHTTPClient
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Contents              []s3Object `xml:"Contents"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []s3Tag  `xml:"TagSet>Tag"`
+}
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+func newS3Client(endpoint, region, accessKey, secretKey string) *s3Client {
+	if region == "" {
+		region = "auto"
+	}
+	return &s3Client{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		http:      newRetryHTTPClient("s3", 5*time.Minute, defaultRetryPolicy, nil),
+	}
+}
+
+// ListObjectsV2 列出 prefix 下 startAfter 之后的全部对象 (自动翻页)
+func (c *s3Client) ListObjectsV2(ctx context.Context, bucket, prefix, startAfter string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if startAfter != "" {
+			query.Set("start-after", startAfter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("解析 ListObjectsV2 响应失败: %v", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (c *s3Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) DeleteObject(ctx context.Context, bucket, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, bucket, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) PutObjectTagging(ctx context.Context, bucket, key string, tags map[string]string) error {
+	tagging := s3Tagging{}
+	for k, v := range tags {
+		tagging.TagSet = append(tagging.TagSet, s3Tag{Key: k, Value: v})
+	}
+	body, err := xml.Marshal(tagging)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	header.Set("Content-Type", "application/xml")
+	resp, err := c.do(ctx, http.MethodPut, bucket, key, url.Values{"tagging": {""}}, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) do(ctx context.Context, method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	path := "/" + bucket
+	if key != "" {
+		path += "/" + key
+	}
+	rawQuery := s3CanonicalQuery(query)
+	u := c.endpoint + s3URIEncode(path, false)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, path, rawQuery, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("### s3 ### %s %s 返回状态码 %d: %s", method, path, resp.StatusCode, string(data))
+	}
+	return resp, nil
+}
+
+func (c *s3Client) sign(req *http.Request, path, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var names []string
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "host" || lk == "content-md5" || lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		v := req.Header.Get(name)
+		if name == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(path, false),
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3URIEncode 按 SigV4 规则编码, 路径中的 / 不编码
+func s3URIEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			sb.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", ch)
+	}
+	return sb.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"bufio"
+	"cf_logpush/dto"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3AfterNone   = "none"
+	s3AfterDelete = "delete"
+	s3AfterTag    = "tag"
+
+	// 对象最后修改时间超过该值后才推进水位, 防止 Logpush 乱序上传的对象被跳过
+	s3SettleDuration = time.Hour
+)
+
+type s3PullerConfig struct {
+	Endpoint   string
+	Region     string
+	Bucket     string
+	Prefix     string
+	AccessKey  string
+	SecretKey  string
+	Interval   time.Duration
+	After      string
+	Checkpoint string
+}
+
+// s3PullCheckpoint Watermark 之前的对象已全部处理, Processed 记录水位之后已处理的对象
+type s3PullCheckpoint struct {
+	Watermark string           `json:"watermark"`
+	Processed map[string]int64 `json:"processed"`
+}
+
+var (
+	s3PullerOnce sync.Once
+)
+
+func loadS3PullerConfig() s3PullerConfig {
+	conf := s3PullerConfig{
+		Endpoint:   os.Getenv("S3_PULL_ENDPOINT"),
+		Region:     os.Getenv("S3_PULL_REGION"),
+		Bucket:     os.Getenv("S3_PULL_BUCKET"),
+		Prefix:     os.Getenv("S3_PULL_PREFIX"),
+		AccessKey:  os.Getenv("S3_PULL_ACCESS_KEY"),
+		SecretKey:  os.Getenv("S3_PULL_SECRET_KEY"),
+		Interval:   envMinutes("S3_PULL_INTERVAL_MIN", 1),
+		After:      os.Getenv("S3_PULL_AFTER"),
+		Checkpoint: os.Getenv("S3_PULL_CHECKPOINT"),
+	}
+	if conf.After == "" {
+		conf.After = s3AfterNone
+	}
+	if conf.Checkpoint == "" {
+		conf.Checkpoint = filepath.Join(dto.LogPath, ".s3_checkpoint.json")
+	}
+	return conf
+}
+
+// StartS3Puller 配置了 S3_PULL_ENDPOINT 和 S3_PULL_BUCKET 时定时拉取 bucket 中的 Logpush 文件
+func StartS3Puller() {
+	s3PullerOnce.Do(func() {
+		conf := loadS3PullerConfig()
+		if conf.Endpoint == "" || conf.Bucket == "" {
+			return
+		}
+		client := newS3Client(conf.Endpoint, conf.Region, conf.AccessKey, conf.SecretKey)
+		log.Printf("### s3-puller ### 启动, bucket: %s, prefix: %s, interval: %v, after: %s\n",
+			conf.Bucket, conf.Prefix, conf.Interval, conf.After)
+		go func() {
+			ticker := time.NewTicker(conf.Interval)
+			defer ticker.Stop()
+			for {
+				if err := pullS3Once(context.Background(), client, conf); err != nil {
+					log.Printf("### s3-puller ### 拉取失败: %v\n", err)
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+func pullS3Once(ctx context.Context, client *s3Client, conf s3PullerConfig) error {
+	cp, err := loadS3PullCheckpoint(conf.Checkpoint)
+	if err != nil {
+		return fmt.Errorf("读取 checkpoint 失败: %v", err)
+	}
+	objects, err := client.ListObjectsV2(ctx, conf.Bucket, conf.Prefix, cp.Watermark)
+	if err != nil {
+		return err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	for _, obj := range objects {
+		if _, done := cp.Processed[obj.Key]; done || strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		lines, err := ingestS3Object(ctx, client, conf.Bucket, obj.Key)
+		if err != nil {
+			log.Printf("### s3-puller ### [key: %s] 处理失败, 下次重试: %v\n", obj.Key, err)
+			continue
+		}
+		fmt.Println("### s3-puller ###", "[key: "+obj.Key+"]", fmt.Sprintf("[lines: %d]", lines))
+		cp.Processed[obj.Key] = time.Now().Unix()
+		if err := saveS3PullCheckpoint(conf.Checkpoint, cp); err != nil {
+			return fmt.Errorf("保存 checkpoint 失败: %v", err)
+		}
+		finishS3Object(ctx, client, conf, obj.Key)
+	}
+
+	settled := time.Now().Add(-s3SettleDuration)
+	for _, obj := range objects {
+		if _, done := cp.Processed[obj.Key]; !done || obj.LastModified.After(settled) {
+			break
+		}
+		cp.Watermark = obj.Key
+	}
+	// 水位之前的对象不会再被列出; 水位之后不再出现在列表中的对象已被删除 (after=delete 时水位不会越过已删除的对象),
+	// 都不需要继续记录, 否则 Processed 会无限增长
+	listed := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		listed[obj.Key] = true
+	}
+	for key := range cp.Processed {
+		if key <= cp.Watermark || !listed[key] {
+			delete(cp.Processed, key)
+		}
+	}
+	return saveS3PullCheckpoint(conf.Checkpoint, cp)
+}
+
+// ingestS3Object 下载对象并逐行走与 HandleLogs 相同的处理流程
+func ingestS3Object(ctx context.Context, client *s3Client, bucket, key string) (int, error) {
+	body, err := client.GetObject(ctx, bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	br := bufio.NewReader(body)
+	var reader io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, fmt.Errorf("创建 gzip 解压缩器时出错: %v", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	return processLogStream(reader)
+}
+
+// processLogStream 按行处理 NDJSON 日志流, 返回处理的行数
+func processLogStream(reader io.Reader) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	lines := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		processLogLine(detectDataset(line), line)
+		lines++
+	}
+	return lines, scanner.Err()
+}
+
+func finishS3Object(ctx context.Context, client *s3Client, conf s3PullerConfig, key string) {
+	var err error
+	switch conf.After {
+	case s3AfterDelete:
+		err = client.DeleteObject(ctx, conf.Bucket, key)
+	case s3AfterTag:
+		err = client.PutObjectTagging(ctx, conf.Bucket, key, map[string]string{
+			"cf-logpush-processed": time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	if err != nil {
+		log.Printf("### s3-puller ### [key: %s] %s 失败: %v\n", key, conf.After, err)
+	}
+}
+
+func loadS3PullCheckpoint(path string) (s3PullCheckpoint, error) {
+	cp := s3PullCheckpoint{Processed: make(map[string]int64)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, err
+	}
+	if cp.Processed == nil {
+		cp.Processed = make(map[string]int64)
+	}
+	return cp, nil
+}
+
+func saveS3PullCheckpoint(path string, cp s3PullCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, fileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 进程内的 S3, 只实现 puller 用到的 ListObjectsV2 (每页 1 个对象)、GetObject、DeleteObject 和 PutObjectTagging
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]time.Time
+	gets    map[string]int
+	tagged  map[string]bool
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string]time.Time), gets: make(map[string]int), tagged: make(map[string]bool)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=ak/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2":
+		var keys []string
+		for k := range f.objects {
+			after := q.Get("start-after")
+			if token := q.Get("continuation-token"); token != "" {
+				after = token
+			}
+			if strings.HasPrefix(k, q.Get("prefix")) && k > after {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var result s3ListResult
+		if len(keys) > 0 {
+			result.Contents = []s3Object{{Key: keys[0], LastModified: f.objects[keys[0]]}}
+			result.IsTruncated = len(keys) > 1
+			result.NextContinuationToken = keys[0]
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodGet:
+		if _, ok := f.objects[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.gets[key]++
+		w.Write([]byte("\n"))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && q.Has("tagging"):
+		f.tagged[key] = true
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPullS3Once(t *testing.T) {
+	old := time.Now().Add(-2 * s3SettleDuration)
+	recent := time.Now()
+	tests := []struct {
+		name          string
+		after         string
+		objects       map[string]time.Time
+		wantGets      int
+		wantRemaining int
+		wantWatermark string
+		wantProcessed []string
+	}{
+		{
+			name:  "after=delete 删除后不再记录已处理的对象",
+			after: s3AfterDelete,
+			objects: map[string]time.Time{
+				"logs/20240101/a.log.gz": old,
+				"logs/20240101/b.log.gz": recent,
+			},
+			wantGets:      2,
+			wantRemaining: 0,
+			wantWatermark: "logs/20240101/a.log.gz",
+			wantProcessed: nil,
+		},
+		{
+			name:  "after=tag 水位只推进到已稳定的对象",
+			after: s3AfterTag,
+			objects: map[string]time.Time{
+				"logs/20240101/a.log.gz": old,
+				"logs/20240101/b.log.gz": recent,
+				"logs/20240101/c.log.gz": old,
+			},
+			wantGets:      3,
+			wantRemaining: 3,
+			wantWatermark: "logs/20240101/a.log.gz",
+			wantProcessed: []string{"logs/20240101/b.log.gz", "logs/20240101/c.log.gz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3("bk")
+			for k, v := range tt.objects {
+				fake.objects[k] = v
+			}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			conf := s3PullerConfig{Bucket: "bk", Prefix: "logs/", After: tt.after, Checkpoint: filepath.Join(t.TempDir(), "cp.json")}
+			client := newS3Client(srv.URL, "", "ak", "sk")
+
+			// 第二次拉取时已处理的对象不能重复下载
+			for i := 0; i < 2; i++ {
+				if err := pullS3Once(context.Background(), client, conf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			gets := 0
+			for k, n := range fake.gets {
+				if n != 1 {
+					t.Fatalf("%s 下载了 %d 次", k, n)
+				}
+				gets += n
+			}
+			if gets != tt.wantGets || len(fake.objects) != tt.wantRemaining {
+				t.Fatalf("下载 %d 个, 剩余 %d 个; 期望下载 %d 个, 剩余 %d 个", gets, len(fake.objects), tt.wantGets, tt.wantRemaining)
+			}
+			if tt.after == s3AfterTag && len(fake.tagged) != len(tt.objects) {
+				t.Fatalf("打标签的对象: %v", fake.tagged)
+			}
+
+			cp, err := loadS3PullCheckpoint(conf.Checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var processed []string
+			for k := range cp.Processed {
+				processed = append(processed, k)
+			}
+			sort.Strings(processed)
+			if cp.Watermark != tt.wantWatermark || strings.Join(processed, ",") != strings.Join(tt.wantProcessed, ",") {
+				t.Fatalf("checkpoint 为 %+v", cp)
+			}
+		})
+	}
+}
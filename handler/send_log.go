@@ -2,34 +2,45 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"time"
 )
 
+var (
+	tdAgentClient = newRetryHTTPClient("td-agent", 10*time.Second, retryPolicy{
+		MaxAttempts:   maxRetry,
+		BaseDelay:     retryInterval,
+		MaxDelay:      4 * retryInterval,
+		MaxRetryAfter: 4 * retryInterval,
+	}, nil)
+)
+
 func SendToTDAgent(logData string) error {
-	for attempt := 1; attempt <= maxRetry; attempt++ {
-		resp, err := http.Post(tdAgentURL, "application/json", bytes.NewBuffer([]byte(logData)))
-		if err != nil {
-			log.Printf("尝试 %d: 发送日志到 td-agent 时出错: %v\n", attempt, err)
-		} else {
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				body, _ := io.ReadAll(resp.Body)
-				err = fmt.Errorf("td-agent 返回状态码 %d: %s", resp.StatusCode, string(body))
-				log.Printf("尝试 %d: %v\n", attempt, err)
-			} else {
-				return nil
-			}
-		}
+	return sendToTDAgentURL(tdAgentURL, logData)
+}
 
-		if attempt < maxRetry {
-			time.Sleep(retryInterval)
-			log.Printf("等待 %v 后重试...\n", retryInterval)
-		}
-	}
+// sendToTDAgentTag 按 tag 发送到 td-agent 的 http 输入, 例如 cf.firewall_events
+func sendToTDAgentTag(tag, logData string) error {
+	return sendToTDAgentURL(tdAgentBaseURL+tag, logData)
+}
 
-	return fmt.Errorf("所有 %d 次尝试发送日志到 td-agent 均失败", maxRetry)
+func sendToTDAgentURL(url, logData string) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewBufferString(logData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := tdAgentClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("发送日志到 td-agent 失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("td-agent 返回状态码 %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
 }
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tencentDebugCapture 一次 GetMetric 的原始 API 响应和解析结果, 可离线重放 formatData
+type tencentDebugCapture struct {
+	RequestID         string             `json:"requestId"`
+	CreatedAt         string             `json:"createdAt"`
+	Domains           []string           `json:"domains"`
+	StartTime         int64              `json:"startTime"`
+	EndTime           int64              `json:"endTime"`
+	EndPoint          string             `json:"endPoint"`
+	Calls             []tencentDebugCall `json:"calls"`
+	DataResults       []CDNDataResult    `json:"dataResults"`
+	DataOriginResults []CDNDataResult    `json:"dataOriginResults"`
+}
+
+type tencentDebugCall struct {
+	Kind     string          `json:"kind"`
+	Domain   string          `json:"domain"`
+	Metric   string          `json:"metric"`
+	Area     string          `json:"area"`
+	District int             `json:"district,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tencentDebugEnabled 请求中 debug=true 或配置 TENCENT_DEBUG_CAPTURE=1 时开启
+func tencentDebugEnabled(req reqForTencentLog) bool {
+	return req.Debug || os.Getenv("TENCENT_DEBUG_CAPTURE") == "1"
+}
+
+func tencentDebugDir() string {
+	if dir := os.Getenv("TENCENT_DEBUG_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(dto.LogPath, ".tencent_debug")
+}
+
+// captureTencentDebug 写入 <时间>-<requestId>.json 并按 TENCENT_DEBUG_MAX_FILES 轮转, 返回文件名
+func captureTencentDebug(req reqForTencentLog, results []tencentTaskResult, dataResults, dataOriginResults []CDNDataResult) string {
+	now := time.Now()
+	capture := tencentDebugCapture{
+		RequestID:         newRequestID(),
+		CreatedAt:         now.Format(time.RFC3339),
+		Domains:           SplitDomains(req.Domains),
+		StartTime:         req.StartTime,
+		EndTime:           req.EndTime,
+		EndPoint:          req.EndPoint,
+		DataResults:       dataResults,
+		DataOriginResults: dataOriginResults,
+	}
+	for _, res := range results {
+		call := tencentDebugCall{
+			Kind:     res.Task.Kind,
+			Domain:   res.Task.Domain,
+			Metric:   res.Task.Metric,
+			Area:     res.Task.DataType,
+			District: res.Task.District,
+			Response: res.Raw,
+		}
+		if res.Err != nil {
+			call.Error = res.Err.Error()
+		}
+		capture.Calls = append(capture.Calls, call)
+	}
+
+	dir := tencentDebugDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("### tencent-debug ### 创建目录失败: %v\n", err)
+		return ""
+	}
+	name := fmt.Sprintf("%s-%s.json", now.Format("20060102T150405"), capture.RequestID)
+	data, err := json.Marshal(capture)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dir, name), data)
+	}
+	if err != nil {
+		log.Printf("### tencent-debug ### 写入 %s 失败: %v\n", name, err)
+		return ""
+	}
+	rotateTencentDebug(dir, envInt("TENCENT_DEBUG_MAX_FILES", 50))
+	return name
+}
+
+func rotateTencentDebug(dir string, maxFiles int) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) <= maxFiles {
+		return
+	}
+	sort.Strings(files)
+	for _, file := range files[:len(files)-maxFiles] {
+		os.Remove(file)
+	}
+}
+
+func replayTencentDebug(path string) (map[string][]map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var capture tencentDebugCapture
+	if err := json.Unmarshal(data, &capture); err != nil {
+		return nil, err
+	}
+	return formatData(capture.DataResults, capture.DataOriginResults), nil
+}
+
+// RunTencentReplay 离线重放抓取文件: cf_logpush tencent-replay <file>
+func RunTencentReplay(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("用法: tencent-replay <capture file>")
+	}
+	formatted, err := replayTencentDebug(args[0])
+	if err != nil {
+		return err
+	}
+	marshal, _ := json.MarshalIndent(formatted, "", "  ")
+	fmt.Println(string(marshal))
+	return nil
+}
+
+// HandleTencentReplay GET /tencent/debug/replay?name=<capture file>
+func HandleTencentReplay(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(r.URL.Query().Get("name"))
+	if name == "." || name == "/" || !strings.HasSuffix(name, ".json") {
+		http.Error(w, "缺少必要参数: name", http.StatusBadRequest)
+		return
+	}
+	formatted, err := replayTencentDebug(filepath.Join(tencentDebugDir(), name))
+	if err != nil {
+		http.Error(w, "重放失败: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	marshal, _ := json.Marshal(map[string]interface{}{
+		"code":   200,
+		"status": "success",
+		"data":   formatted,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshal)
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// 默认地区表, 来自 https://cloud.tencent.com/document/product/228/6316 区域/运营商映射表,
+// 可通过 TENCENT_DISTRICT_CONFIG 指定的文件覆盖或追加, 新增市场无需改代码
+//
+//go:embed tencent_districts.json
+var defaultTencentDistricts []byte
+
+// tencentDistrict Country 为 ISO 3166-1 alpha-2 小写, 大区编码 (2000000001 等) 没有对应国家;
+// Query 为 true 时 overseas 查询会按该 district 单独拉取
+type tencentDistrict struct {
+	Code    int    `json:"code"`
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	Region  string `json:"region"`
+	Query   bool   `json:"query"`
+}
+
+// tencentDistrictConfig TeoMetrics 为 EdgeOne 指标名到 formatData 使用的 CDN 指标名的映射
+type tencentDistrictConfig struct {
+	Metrics       []string          `json:"metrics"`
+	OriginMetrics []string          `json:"originMetrics"`
+	Dimensions    []string          `json:"dimensions"`
+	TeoMetrics    map[string]string `json:"teoMetrics"`
+	Districts     []tencentDistrict `json:"districts"`
+
+	byCode map[int]tencentDistrict
+}
+
+var tencentConf = loadTencentDistrictConfig()
+
+func loadTencentDistrictConfig() *tencentDistrictConfig {
+	conf := &tencentDistrictConfig{}
+	if err := json.Unmarshal(defaultTencentDistricts, conf); err != nil {
+		panic(fmt.Sprintf("解析默认腾讯地区表失败: %v", err))
+	}
+	if path := os.Getenv("TENCENT_DISTRICT_CONFIG"); path != "" {
+		if err := conf.merge(path); err != nil {
+			log.Printf("### tencent ### 加载 %s 失败, 使用默认地区表: %v\n", path, err)
+		}
+	}
+	conf.index()
+	return conf
+}
+
+// merge 覆盖文件中非空的 metrics/originMetrics/dimensions/teoMetrics 整体替换, districts 按 code 覆盖或追加
+func (c *tencentDistrictConfig) merge(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var override tencentDistrictConfig
+	if err := json.Unmarshal(data, &override); err != nil {
+		return err
+	}
+	if len(override.Metrics) > 0 {
+		c.Metrics = override.Metrics
+	}
+	if len(override.OriginMetrics) > 0 {
+		c.OriginMetrics = override.OriginMetrics
+	}
+	if len(override.Dimensions) > 0 {
+		c.Dimensions = override.Dimensions
+	}
+	if len(override.TeoMetrics) > 0 {
+		c.TeoMetrics = override.TeoMetrics
+	}
+	pos := make(map[int]int, len(c.Districts))
+	for i, d := range c.Districts {
+		pos[d.Code] = i
+	}
+	for _, d := range override.Districts {
+		if i, ok := pos[d.Code]; ok {
+			c.Districts[i] = d
+			continue
+		}
+		pos[d.Code] = len(c.Districts)
+		c.Districts = append(c.Districts, d)
+	}
+	return nil
+}
+
+func (c *tencentDistrictConfig) index() {
+	c.byCode = make(map[int]tencentDistrict, len(c.Districts))
+	for _, d := range c.Districts {
+		c.byCode[d.Code] = d
+	}
+}
+
+// queryDistricts overseas 需要单独查询的 district 编码
+func (c *tencentDistrictConfig) queryDistricts() []int {
+	var codes []int
+	for _, d := range c.Districts {
+		if d.Query {
+			codes = append(codes, d.Code)
+		}
+	}
+	return codes
+}
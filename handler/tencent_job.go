@@ -0,0 +1,488 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tencentJobPending  = "pending"
+	tencentJobRunning  = "running"
+	tencentJobDone     = "done"
+	tencentJobFailed   = "failed"
+	tencentJobCanceled = "canceled"
+
+	tencentJobSaveInterval = 2 * time.Second
+
+	// tencentJobKindMetric 查询统计数据, tencentJobKindConvert 下载离线日志并转换写入 LogPath
+	tencentJobKindMetric  = "metric"
+	tencentJobKindConvert = "convert"
+)
+
+// tencentJob 异步采集任务, 落盘时不保存 SecretKey, 服务重启后未完成的任务标记为失败
+type tencentJob struct {
+	ID         string                             `json:"id"`
+	Kind       string                             `json:"kind"`
+	Status     string                             `json:"status"`
+	Domains    []string                           `json:"domains"`
+	StartTime  int64                              `json:"startTime"`
+	EndTime    int64                              `json:"endTime"`
+	EndPoint   string                             `json:"endPoint"`
+	CreatedAt  int64                              `json:"createdAt"`
+	UpdatedAt  int64                              `json:"updatedAt"`
+	FinishedAt int64                              `json:"finishedAt,omitempty"`
+	Total      int                                `json:"total"`
+	Done       int                                `json:"done"`
+	Failed     int                                `json:"failed"`
+	Error      string                             `json:"error,omitempty"`
+	Domain     map[string]*tencentJobDomainStatus `json:"domain"`
+
+	cancel   context.CancelFunc
+	lastSave time.Time
+}
+
+type tencentJobDomainStatus struct {
+	Total  int      `json:"total"`
+	Done   int      `json:"done"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type tencentJobDomainResult struct {
+	Status string                   `json:"status"`
+	Data   []map[string]interface{} `json:"data"`
+	Errors []string                 `json:"errors,omitempty"`
+}
+
+type tencentJobManager struct {
+	mu   sync.Mutex
+	dir  string
+	ttl  time.Duration
+	jobs map[string]*tencentJob
+}
+
+var (
+	tencentJobs     *tencentJobManager
+	tencentJobsOnce sync.Once
+)
+
+// StartTencentJobs 加载磁盘上的任务状态并启动过期清理
+func StartTencentJobs() {
+	tencentJobsOnce.Do(func() {
+		dir := os.Getenv("TENCENT_JOB_DIR")
+		if dir == "" {
+			dir = filepath.Join(dto.LogPath, ".tencent_jobs")
+		}
+		m := &tencentJobManager{
+			dir:  dir,
+			ttl:  time.Duration(envInt("TENCENT_JOB_TTL_HOURS", 24)) * time.Hour,
+			jobs: make(map[string]*tencentJob),
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			log.Printf("### tencent-job ### 创建任务目录失败: %v\n", err)
+		}
+		m.load()
+		tencentJobs = m
+		go func() {
+			ticker := time.NewTicker(10 * time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				m.cleanup()
+			}
+		}()
+	})
+}
+
+func (m *tencentJobManager) statePath(id string) string {
+	return filepath.Join(m.dir, id+".json")
+}
+
+func (m *tencentJobManager) resultPath(id string) string {
+	return filepath.Join(m.dir, id+".result.json")
+}
+
+func (m *tencentJobManager) load() {
+	files, _ := filepath.Glob(filepath.Join(m.dir, "*.json"))
+	for _, file := range files {
+		if strings.HasSuffix(file, ".result.json") {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		job := &tencentJob{}
+		if err := json.Unmarshal(data, job); err != nil || job.ID == "" {
+			continue
+		}
+		if job.Status == tencentJobPending || job.Status == tencentJobRunning {
+			job.Status = tencentJobFailed
+			job.Error = "服务重启, 任务中断"
+			job.FinishedAt = time.Now().Unix()
+			m.saveLocked(job)
+		}
+		m.jobs[job.ID] = job
+	}
+}
+
+// saveLocked 调用方需持有 m.mu
+func (m *tencentJobManager) saveLocked(job *tencentJob) {
+	job.UpdatedAt = time.Now().Unix()
+	job.lastSave = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(m.statePath(job.ID), data); err != nil {
+		log.Printf("### tencent-job ### [id: %s] 保存任务状态失败: %v\n", job.ID, err)
+	}
+}
+
+func (m *tencentJobManager) cleanup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deadline := time.Now().Add(-m.ttl).Unix()
+	for id, job := range m.jobs {
+		if job.FinishedAt == 0 || job.FinishedAt > deadline {
+			continue
+		}
+		os.Remove(m.statePath(id))
+		os.Remove(m.resultPath(id))
+		delete(m.jobs, id)
+	}
+}
+
+func (m *tencentJobManager) create(req reqForTencentLog) *tencentJob {
+	domains := SplitDomains(req.Domains)
+	tasks := buildTencentMetricTasks(domains)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &tencentJob{
+		ID:        newRequestID(),
+		Kind:      tencentJobKindMetric,
+		Status:    tencentJobPending,
+		Domains:   domains,
+		StartTime: req.StartTime,
+		EndTime:   req.EndTime,
+		EndPoint:  req.EndPoint,
+		CreatedAt: time.Now().Unix(),
+		Total:     len(tasks),
+		Domain:    make(map[string]*tencentJobDomainStatus),
+		cancel:    cancel,
+	}
+	for _, task := range tasks {
+		if job.Domain[task.Domain] == nil {
+			job.Domain[task.Domain] = &tencentJobDomainStatus{}
+		}
+		job.Domain[task.Domain].Total++
+	}
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.saveLocked(job)
+	m.mu.Unlock()
+
+	go m.run(ctx, job, req, tasks)
+	return job
+}
+
+func (m *tencentJobManager) run(ctx context.Context, job *tencentJob, req reqForTencentLog, tasks []tencentQueryTask) {
+	defer job.cancel()
+	m.mu.Lock()
+	job.Status = tencentJobRunning
+	m.saveLocked(job)
+	m.mu.Unlock()
+
+	client := newTencentCdnClient(req, "ap-shanghai")
+	results := runTencentTasks(ctx, req, client, tasks, func(res tencentTaskResult) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		job.Done++
+		ds := job.Domain[res.Task.Domain]
+		ds.Done++
+		if res.Err != nil {
+			job.Failed++
+			ds.Errors = append(ds.Errors, fmt.Sprintf("[metric: %s] [area: %s] [district: %d] %v",
+				res.Task.Metric, res.Task.DataType, res.Task.District, res.Err))
+		}
+		if time.Since(job.lastSave) > tencentJobSaveInterval {
+			m.saveLocked(job)
+		}
+	})
+
+	byDomain := make(map[string][]tencentTaskResult)
+	for _, res := range results {
+		byDomain[res.Task.Domain] = append(byDomain[res.Task.Domain], res)
+	}
+	output := make(map[string]*tencentJobDomainResult)
+	for _, domain := range job.Domains {
+		dataResults, dataOriginResults := splitTencentResults(byDomain[domain])
+		domainResult := &tencentJobDomainResult{Status: tencentJobDone, Data: formatData(dataResults, dataOriginResults)[domain]}
+		m.mu.Lock()
+		ds := job.Domain[domain]
+		if ds != nil {
+			domainResult.Errors = append([]string{}, ds.Errors...)
+			// 未被 worker 执行的任务(取消时)不会回调, 这里补记错误
+			if ds.Done < ds.Total {
+				domainResult.Errors = append(domainResult.Errors, fmt.Sprintf("%d 个查询未执行", ds.Total-ds.Done))
+			}
+		}
+		m.mu.Unlock()
+		if len(domainResult.Errors) > 0 {
+			domainResult.Status = "partial"
+			if len(domainResult.Data) == 0 {
+				domainResult.Status = tencentJobFailed
+			}
+		}
+		output[domain] = domainResult
+	}
+	if tencentDebugEnabled(req) {
+		dataResults, dataOriginResults := splitTencentResults(results)
+		captureTencentDebug(req, results, dataResults, dataOriginResults)
+	}
+	m.finish(ctx, job, output)
+}
+
+// createConvert 创建离线日志转换任务, 总数在查询到日志文件列表后才确定
+func (m *tencentJobManager) createConvert(req reqForTencentLog) *tencentJob {
+	domains := SplitDomains(req.Domains)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &tencentJob{
+		ID:        newRequestID(),
+		Kind:      tencentJobKindConvert,
+		Status:    tencentJobPending,
+		Domains:   domains,
+		StartTime: req.StartTime,
+		EndTime:   req.EndTime,
+		EndPoint:  req.EndPoint,
+		CreatedAt: time.Now().Unix(),
+		Domain:    make(map[string]*tencentJobDomainStatus),
+		cancel:    cancel,
+	}
+	for _, domain := range domains {
+		job.Domain[domain] = &tencentJobDomainStatus{}
+	}
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.saveLocked(job)
+	m.mu.Unlock()
+
+	go m.runConvert(ctx, job, req)
+	return job
+}
+
+// runConvert 逐个 domain+区域查询日志文件列表并下载转换, 单个文件或区域失败记录在 Errors 中, 不影响其他文件
+func (m *tencentJobManager) runConvert(ctx context.Context, job *tencentJob, req reqForTencentLog) {
+	defer job.cancel()
+	m.mu.Lock()
+	job.Status = tencentJobRunning
+	m.saveLocked(job)
+	m.mu.Unlock()
+
+	// update 在持锁状态下修改任务进度, 并按间隔落盘
+	update := func(fn func()) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		fn()
+		if time.Since(job.lastSave) > tencentJobSaveInterval {
+			m.saveLocked(job)
+		}
+	}
+
+	client := newTencentCdnClient(req, "")
+	startTime := GetTimeStr(req.StartTime)
+	endTime := GetTimeStr(req.EndTime)
+	limiter := tencentLimiter(req.SecretID)
+	reports := []tencentLogFileReport{}
+	for _, domain := range job.Domains {
+		for _, dim := range tencentConf.Dimensions {
+			if ctx.Err() != nil {
+				break
+			}
+			logs, err := queryDomainLogs(ctx, client, limiter, domain, startTime, endTime, dim)
+			if err != nil {
+				reports = append(reports, tencentLogFileReport{Domain: domain, Area: dim, Error: err.Error()})
+				update(func() {
+					job.Failed++
+					job.Domain[domain].Errors = append(job.Domain[domain].Errors, fmt.Sprintf("[area: %s] 查询日志列表失败: %v", dim, err))
+				})
+				continue
+			}
+			update(func() {
+				job.Total += len(logs)
+				job.Domain[domain].Total += len(logs)
+			})
+			for _, l := range logs {
+				if ctx.Err() != nil {
+					break
+				}
+				if l.LogPath == nil {
+					continue
+				}
+				report := convertTencentLogURL(ctx, *l.LogPath)
+				report.Domain, report.Area = domain, dim
+				if l.LogName != nil {
+					report.LogName = *l.LogName
+				}
+				reports = append(reports, report)
+				update(func() {
+					job.Done++
+					job.Domain[domain].Done++
+					if report.Error != "" {
+						job.Failed++
+						job.Domain[domain].Errors = append(job.Domain[domain].Errors, fmt.Sprintf("[file: %s] %s", report.LogName, report.Error))
+					}
+				})
+			}
+		}
+	}
+	FlushLogs()
+	m.finish(ctx, job, reports)
+}
+
+// finish 保存任务结果并更新最终状态
+func (m *tencentJobManager) finish(ctx context.Context, job *tencentJob, output interface{}) {
+	data, err := json.Marshal(output)
+	if err == nil {
+		err = writeFileAtomic(m.resultPath(job.ID), data)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.FinishedAt = time.Now().Unix()
+	switch {
+	case ctx.Err() != nil:
+		job.Status = tencentJobCanceled
+	case err != nil:
+		job.Status = tencentJobFailed
+		job.Error = "保存结果失败: " + err.Error()
+	default:
+		job.Status = tencentJobDone
+	}
+	m.saveLocked(job)
+}
+
+func (m *tencentJobManager) get(id string) (tencentJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return tencentJob{}, false
+	}
+	snapshot := *job
+	snapshot.Domain = make(map[string]*tencentJobDomainStatus, len(job.Domain))
+	for k, v := range job.Domain {
+		ds := *v
+		ds.Errors = append([]string{}, v.Errors...)
+		snapshot.Domain[k] = &ds
+	}
+	return snapshot, true
+}
+
+func (m *tencentJobManager) cancelJob(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return false
+	}
+	if job.cancel != nil {
+		job.cancel()
+	}
+	return true
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, fileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeJobResponse(w http.ResponseWriter, code int, data interface{}) {
+	res := map[string]interface{}{
+		"code":   code,
+		"status": "success",
+		"data":   data,
+	}
+	if code != http.StatusOK {
+		res["status"] = "fail"
+	}
+	marshal, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(marshal)
+}
+
+// HandleTencentJobs POST 创建任务, GET ?id= 查询状态和进度, DELETE ?id= 取消任务
+func HandleTencentJobs(w http.ResponseWriter, r *http.Request) {
+	StartTencentJobs()
+	switch r.Method {
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, 32<<20)
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "读取请求体时出错", http.StatusBadRequest)
+			return
+		}
+		req := reqForTencentLog{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "无效的 JSON 数据", http.StatusBadRequest)
+			return
+		}
+		if req.SecretID == "" || req.SecretKey == "" || req.Domains == "" || req.StartTime == 0 || req.EndTime == 0 {
+			http.Error(w, "缺少必要参数: secretId, secretKey, domains, startTime, endTime", http.StatusBadRequest)
+			return
+		}
+		job := tencentJobs.create(req)
+		writeJobResponse(w, http.StatusOK, map[string]interface{}{"id": job.ID, "total": job.Total})
+	case http.MethodGet:
+		job, ok := tencentJobs.get(r.URL.Query().Get("id"))
+		if !ok {
+			writeJobResponse(w, http.StatusNotFound, "任务不存在")
+			return
+		}
+		writeJobResponse(w, http.StatusOK, job)
+	case http.MethodDelete:
+		if !tencentJobs.cancelJob(r.URL.Query().Get("id")) {
+			writeJobResponse(w, http.StatusNotFound, "任务不存在")
+			return
+		}
+		writeJobResponse(w, http.StatusOK, "已取消")
+	default:
+		http.Error(w, "仅支持 POST/GET/DELETE 方法", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleTencentJobResult GET ?id= 获取已结束任务的按域名结果
+func HandleTencentJobResult(w http.ResponseWriter, r *http.Request) {
+	StartTencentJobs()
+	id := r.URL.Query().Get("id")
+	job, ok := tencentJobs.get(id)
+	if !ok {
+		writeJobResponse(w, http.StatusNotFound, "任务不存在")
+		return
+	}
+	if job.FinishedAt == 0 {
+		writeJobResponse(w, http.StatusConflict, fmt.Sprintf("任务未完成, 当前进度 %d/%d", job.Done, job.Total))
+		return
+	}
+	data, err := os.ReadFile(tencentJobs.resultPath(id))
+	if err != nil {
+		writeJobResponse(w, http.StatusNotFound, "任务结果不存在: "+job.Error)
+		return
+	}
+	writeJobResponse(w, http.StatusOK, json.RawMessage(data))
+}
@@ -9,9 +9,9 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	cdn "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cdn/v20180606"
@@ -20,13 +20,6 @@ import (
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 )
 
-var (
-	metrics       = []string{"flux", "hitFlux", "request", "hitRequest", "bandwidth", "2xx", "3xx", "4xx", "5xx"}
-	originMetrics = []string{"flux", "request", "bandwidth", "statusCode", "2xx", "3xx", "4xx", "5xx"}
-	dimensions    = []string{"overseas", "mainland"}
-	tRegion       = []int{2000000004, 2000000001, 2000000002, 2000000003, 2000000005, 2000000006, 2000000007, 2000000008, 1176, 1195, 73}
-)
-
 type reqForTencentLog struct {
 	SecretID  string `json:"secretId"`
 	SecretKey string `json:"secretKey"`
@@ -34,14 +27,22 @@ type reqForTencentLog struct {
 	StartTime int64  `json:"startTime"`
 	EndTime   int64  `json:"endTime"`
 	EndPoint  string `json:"endPoint"`
+	Debug     bool   `json:"debug"`
+	// Persist 为 true 时把结果按 TENCENT_PERSIST_SINKS 落库, TenantId 写入每条记录
+	Persist  bool   `json:"persist"`
+	TenantId string `json:"tenantId"`
+	// ZoneIds EdgeOne 站点 ID, 逗号分隔, 仅 /tencent/teo/* 使用
+	ZoneIds string `json:"zoneIds"`
 }
 
+// CDNDataResult Unix 为 Timestamps 对应的 unix 秒, 接口直接返回时间戳时 (EdgeOne) 填写, formatData 不再解析东八区时间字符串
 type CDNDataResult struct {
 	Domain     string
 	DataType   string
 	Location   int
 	Metric     string
 	Timestamps []string
+	Unix       []int64
 	Values     []int64
 }
 
@@ -78,7 +79,7 @@ func HandleTencentOnTimeLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	m := GetMetric(req)
+	m := GetMetric(r.Context(), req)
 	marshal, _ := json.Marshal(m)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -104,100 +105,105 @@ func HandleTencentZipLog(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("无效的 JSON 数据: %s\n", err.Error())
 		http.Error(w, "无效的 JSON 数据", http.StatusBadRequest)
+		return
 	}
 
-	m := GetLog(req)
+	m := GetLog(r.Context(), req)
 	marshal, _ := json.Marshal(m)
-	w.Write(marshal)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(marshal)
 }
 
-func GetMetric(req reqForTencentLog) interface{} {
-	secretId := req.SecretID
-	secretKey := req.SecretKey
+func GetMetric(ctx context.Context, req reqForTencentLog) interface{} {
 	domains := SplitDomains(req.Domains)
+	client := newTencentCdnClient(req, "ap-shanghai")
+	tasks := buildTencentMetricTasks(domains)
+	results := runTencentTasks(ctx, req, client, tasks, nil)
+	dataResults, dataOriginResults := splitTencentResults(results)
 
-	credential := common.NewCredential(secretId, secretKey)
-	cpf := profile.NewClientProfile()
+	formattedData := formatData(dataResults, dataOriginResults)
+
+	var (
+		res = make(map[string]interface{})
+	)
+	res["code"] = 200
+	res["status"] = "success"
+	res["data"] = formattedData
+	if req.Persist {
+		written, err := persistTencentData(tencentPersistSinks(), req.TenantId, formattedData)
+		res["persisted"] = written
+		if err != nil {
+			log.Printf("### tencent ### 落库失败: %v\n", err)
+			res["persistError"] = err.Error()
+		}
+	}
+	if tencentDebugEnabled(req) {
+		res["debugCapture"] = captureTencentDebug(req, results, dataResults, dataOriginResults)
+	}
+	return res
+}
+
+func newTencentCdnClient(req reqForTencentLog, region string) *cdn.Client {
+	credential := common.NewCredential(req.SecretID, req.SecretKey)
 	//cpf.HttpProfile.Endpoint = "cdn.tencentcloudapi.com"
-	cpf.HttpProfile.Endpoint = req.EndPoint
-	client, _ := cdn.NewClient(credential, "ap-shanghai", cpf)
+	client, _ := cdn.NewClient(credential, region, tencentClientProfile(req.EndPoint))
+	client.WithHttpTransport(tencentTransport)
+	return client
+}
+
+// tencentTransport 腾讯云 SDK 的请求走共用的重试/熔断, 限频由调用方按 SecretId 的令牌桶控制, 这里不再限流.
+// 接口的业务错误 (含 RequestLimitExceeded) 以 200 返回, 不在这里重试
+var tencentTransport = newRetryHTTPClient("tencent-api", 0, defaultRetryPolicy, nil)
 
-	totalQueryCount := len(domains) * len(metrics) * (1 + len(tRegion))
-	results := make(chan CDNDataResult, totalQueryCount)
-	originResults := make(chan CDNDataResult, len(domains)*len(dimensions)*len(originMetrics))
+func tencentClientProfile(endpoint string) *profile.ClientProfile {
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = endpoint
+	// 测试时可传入 http:// 开头的地址指向本地模拟服务
+	if strings.HasPrefix(endpoint, "http://") {
+		cpf.HttpProfile.Scheme = "HTTP"
+		cpf.HttpProfile.Endpoint = strings.TrimPrefix(endpoint, "http://")
+	}
+	return cpf
+}
 
-	var queriesStarted = 0
+func buildTencentMetricTasks(domains []string) []tencentQueryTask {
+	var tasks []tencentQueryTask
 	for _, domain := range domains {
 		// 先查询mainland数据
-		for _, metric := range metrics {
-			go queryDimensionData(req, client, metric, domain, "mainland", 0, results)
-			queriesStarted++
-			time.Sleep(60 * time.Millisecond)
+		for _, metric := range tencentConf.Metrics {
+			tasks = append(tasks, tencentQueryTask{Kind: tencentTaskCdn, Metric: metric, Domain: domain, DataType: "mainland"})
 		}
 
-		// 再查询overseas数据，先不带district
-		//for _, metric := range metrics {
-		//	go queryDimensionData(req, client, metric, domain, "overseas", 0, results)
-		//	queriesStarted++
-		//	time.Sleep(50 * time.Millisecond)
-		//}
-
-		// 最后查询overseas带district的数据
-		for _, metric := range metrics {
-			for _, r := range tRegion {
-				go queryDimensionData(req, client, metric, domain, "overseas", r, results)
-				queriesStarted++
-				time.Sleep(90 * time.Millisecond)
+		// 再查询overseas带district的数据
+		for _, metric := range tencentConf.Metrics {
+			for _, r := range tencentConf.queryDistricts() {
+				tasks = append(tasks, tencentQueryTask{Kind: tencentTaskCdn, Metric: metric, Domain: domain, DataType: "overseas", District: r})
 			}
 		}
 
 		// 回源数据查询
-		for _, metric := range originMetrics {
-			for _, dim := range dimensions {
-				go queryDimensionOriginData(req, client, metric, domain, dim, originResults)
-				time.Sleep(50 * time.Millisecond)
+		for _, metric := range tencentConf.OriginMetrics {
+			for _, dim := range tencentConf.Dimensions {
+				tasks = append(tasks, tencentQueryTask{Kind: tencentTaskOrigin, Metric: metric, Domain: domain, DataType: dim})
 			}
 		}
 	}
+	return tasks
+}
 
-	var dataResults, dataOriginResults []CDNDataResult
-	//time.Sleep(time.Second * 5)
-	//fmt.Println("queriesStarted", queriesStarted)
-	//fmt.Println("results", len(results))
-	for i := 0; i < queriesStarted; i++ {
-		if res := <-results; res.Metric != "" {
-			dataResults = append(dataResults, res)
-		}
-	}
-	close(results)
-	originQueryCount := len(domains) * len(dimensions) * len(originMetrics)
-	//fmt.Println("originQueryCount", originQueryCount)
-	//fmt.Println("originResults", len(originResults))
-	for i := 0; i < originQueryCount; i++ {
-		if res := <-originResults; res.Metric != "" {
-			dataOriginResults = append(dataOriginResults, res)
+func splitTencentResults(results []tencentTaskResult) (dataResults, dataOriginResults []CDNDataResult) {
+	for _, res := range results {
+		if res.Task.Kind == tencentTaskOrigin {
+			dataOriginResults = append(dataOriginResults, res.Results...)
+			continue
 		}
+		dataResults = append(dataResults, res.Results...)
 	}
-	close(originResults)
-
-	marshal, _ := json.Marshal(dataResults)
-	os.WriteFile("./test/log/dataResults.json", marshal, 0664)
-	marshal1, _ := json.Marshal(dataOriginResults)
-	os.WriteFile("./test/log/dataOriginResults.json", marshal1, 0664)
-
-	formattedData := formatData(dataResults, dataOriginResults)
-
-	var (
-		res = make(map[string]interface{})
-	)
-	res["code"] = 200
-	res["status"] = "success"
-	res["data"] = formattedData
-	return res
+	return
 }
 
-func queryDimensionOriginData(param reqForTencentLog, client *cdn.Client, metric, domain, dataType string, ch chan<- CDNDataResult) {
+func queryDimensionOriginData(ctx context.Context, param reqForTencentLog, client *cdn.Client, metric, domain, dataType string) ([]CDNDataResult, json.RawMessage, error) {
 	req := cdn.NewDescribeOriginDataRequest()
 	req.StartTime = common.StringPtr(GetTimeStr(param.StartTime))
 	req.EndTime = common.StringPtr(GetTimeStr(param.EndTime))
@@ -210,36 +216,34 @@ func queryDimensionOriginData(param reqForTencentLog, client *cdn.Client, metric
 	} else {
 		req.Area = common.StringPtr("mainland")
 	}
-	//fmt.Printf("queryDimensionOriginData req %+v \n", req.ToJsonString())
-	resp, err := DescribeOriginDataWithContext(context.Background(), client, req)
+	resp, err := DescribeOriginDataWithContext(ctx, client, req)
 	if err != nil {
 		if sdkErr, ok := err.(*errors.TencentCloudSDKError); ok {
 			fmt.Printf("queryDimensionOriginData(origin) API Error[%s]Msg[%s]Id[%s]\n", sdkErr.GetCode(), sdkErr.GetMessage(), sdkErr.GetRequestId())
 		}
-		ch <- CDNDataResult{}
-		return
+		return nil, nil, err
 	}
-	//fmt.Printf("queryDimensionOriginData resp %+v \n", resp.ToJsonString())
 	// 解析数据
-	if len(resp.Response.Data) != 0 {
-		for _, item := range resp.Response.Data {
-			result := CDNDataResult{
-				Domain:   domain,
-				DataType: dataType,
-			}
+	var results []CDNDataResult
+	for _, item := range resp.Response.Data {
+		result := CDNDataResult{
+			Domain:   domain,
+			DataType: dataType,
+		}
 
-			for _, metricData := range item.OriginData {
-				result.Metric = *metricData.Metric
-				for _, detail := range metricData.DetailData {
-					result.Timestamps = append(result.Timestamps, *detail.Time)
-					result.Values = append(result.Values, int64(*detail.Value))
-				}
+		for _, metricData := range item.OriginData {
+			result.Metric = *metricData.Metric
+			for _, detail := range metricData.DetailData {
+				result.Timestamps = append(result.Timestamps, *detail.Time)
+				result.Values = append(result.Values, int64(*detail.Value))
 			}
-			ch <- result
 		}
-		return
+		if result.Metric != "" {
+			results = append(results, result)
+		}
 	}
-	ch <- CDNDataResult{}
+	raw, _ := json.Marshal(resp)
+	return results, raw, nil
 }
 
 func DescribeOriginDataWithContext(ctx context.Context, client *cdn.Client, request *cdn.DescribeOriginDataRequest) (response *DescribeOriginDataResponse, err error) {
@@ -265,176 +269,169 @@ func NewDescribeOriginDataResponse() (response *DescribeOriginDataResponse) {
 	return
 }
 
-func queryDimensionData(param reqForTencentLog, client *cdn.Client, metric, domain, dataType string, r int, ch chan<- CDNDataResult) {
-	// 对于mainland数据类型或r为0，不设置District参数
-	if dataType == "mainland" {
-		req := cdn.NewDescribeCdnDataRequest()
-		req.StartTime = common.StringPtr(GetTimeStr(param.StartTime))
-		req.EndTime = common.StringPtr(GetTimeStr(param.EndTime))
-		req.Metric = common.StringPtr(metric)
-		req.Domains = []*string{&domain}
-		req.Interval = common.StringPtr("min")
-
-		// 设置区域参数
-		//if dataType == "overseas" {
-		//	req.Area = common.StringPtr("overseas")
-		//} else {
-		//	req.Area = common.StringPtr("mainland")
-		//}
-		req.Area = common.StringPtr("mainland")
-
-		resp, err := client.DescribeCdnData(req)
-		if err != nil {
-			if sdkErr, ok := err.(*errors.TencentCloudSDKError); ok {
-				fmt.Printf("queryDimensionData(mainland) API Error[%s]Msg[%s]Id[%s]\n", sdkErr.GetCode(), sdkErr.GetMessage(), sdkErr.GetRequestId())
-			}
-			ch <- CDNDataResult{}
-			return
-		}
-
-		if len(resp.Response.Data) != 0 {
-			for _, item := range resp.Response.Data {
-				result := CDNDataResult{
-					Domain:   domain,
-					DataType: dataType,
-					Location: 0,
-				}
-
-				for _, metricData := range item.CdnData {
-					result.Metric = *metricData.Metric
-					for _, detail := range metricData.DetailData {
-						result.Timestamps = append(result.Timestamps, *detail.Time)
-						result.Values = append(result.Values, int64(*detail.Value))
-					}
-				}
-				ch <- result
-			}
-			return
+func queryDimensionData(ctx context.Context, param reqForTencentLog, client *cdn.Client, metric, domain, dataType string, r int) ([]CDNDataResult, json.RawMessage, error) {
+	req := cdn.NewDescribeCdnDataRequest()
+	req.StartTime = common.StringPtr(GetTimeStr(param.StartTime))
+	req.EndTime = common.StringPtr(GetTimeStr(param.EndTime))
+	req.Metric = common.StringPtr(metric)
+	req.Domains = []*string{&domain}
+	req.Interval = common.StringPtr("min")
+	req.Area = common.StringPtr("mainland")
+	location := 0
+	// 只有overseas数据类型且r不为0时才使用District参数, 查询中国境外CDN数据时，可指定地区类型查询
+	if dataType == "overseas" {
+		if r == 0 {
+			return nil, nil, nil
 		}
-		ch <- CDNDataResult{}
-		return
-	}
-
-	// 只有overseas数据类型且r不为0时才使用District参数
-	if dataType == "overseas" && r != 0 {
-		req := cdn.NewDescribeCdnDataRequest()
-		req.StartTime = common.StringPtr(GetTimeStr(param.StartTime))
-		req.EndTime = common.StringPtr(GetTimeStr(param.EndTime))
-		req.Metric = common.StringPtr(metric)
-		req.Domains = []*string{&domain}
-		req.Interval = common.StringPtr("min")
-		// 查询中国境外CDN数据时，可指定地区类型查询
 		req.Area = common.StringPtr("overseas")
-		//req.AreaType = common.StringPtr("server")
 		req.District = common.Int64Ptr(int64(r))
+		location = r
+	}
 
-		resp, err := client.DescribeCdnData(req)
-		if err != nil {
-			if sdkErr, ok := err.(*errors.TencentCloudSDKError); ok {
-				fmt.Printf("queryDimensionData(overseas) API Error[%s]Msg[%s]Id[%s]\n", sdkErr.GetCode(), sdkErr.GetMessage(), sdkErr.GetRequestId())
-			}
-			ch <- CDNDataResult{}
-			return
+	resp, err := client.DescribeCdnDataWithContext(ctx, req)
+	if err != nil {
+		if sdkErr, ok := err.(*errors.TencentCloudSDKError); ok {
+			fmt.Printf("queryDimensionData(%s) API Error[%s]Msg[%s]Id[%s]\n", dataType, sdkErr.GetCode(), sdkErr.GetMessage(), sdkErr.GetRequestId())
 		}
+		return nil, nil, err
+	}
 
-		if len(resp.Response.Data) != 0 {
-			for _, item := range resp.Response.Data {
-				result := CDNDataResult{
-					Domain:   domain,
-					DataType: dataType,
-					Location: r,
-				}
+	var results []CDNDataResult
+	for _, item := range resp.Response.Data {
+		result := CDNDataResult{
+			Domain:   domain,
+			DataType: dataType,
+			Location: location,
+		}
 
-				for _, metricData := range item.CdnData {
-					result.Metric = *metricData.Metric
-					for _, detail := range metricData.DetailData {
-						result.Timestamps = append(result.Timestamps, *detail.Time)
-						result.Values = append(result.Values, int64(*detail.Value))
-					}
-				}
-				ch <- result
+		for _, metricData := range item.CdnData {
+			result.Metric = *metricData.Metric
+			for _, detail := range metricData.DetailData {
+				result.Timestamps = append(result.Timestamps, *detail.Time)
+				result.Values = append(result.Values, int64(*detail.Value))
 			}
-			return
 		}
-		ch <- CDNDataResult{}
+		if result.Metric != "" {
+			results = append(results, result)
+		}
 	}
+	raw, _ := json.Marshal(resp)
+	return results, raw, nil
 }
 
-func GetLog(req reqForTencentLog) interface{} {
-	secretId := req.SecretID
-	secretKey := req.SecretKey
+func GetLog(ctx context.Context, req reqForTencentLog) interface{} {
 	domains := SplitDomains(req.Domains)
 	startTime := GetTimeStr(req.StartTime)
 	endTime := GetTimeStr(req.EndTime)
+	client := newTencentCdnClient(req, "")
 
-	credential := common.NewCredential(secretId, secretKey)
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = req.EndPoint
-	client, _ := cdn.NewClient(credential, "", cpf)
+	type logTask struct {
+		domain string
+		dim    string
+		logs   []*cdn.DomainLog
+		err    error
+	}
+	var tasks []*logTask
+	for _, domain := range domains {
+		for _, dim := range tencentConf.Dimensions {
+			tasks = append(tasks, &logTask{domain: domain, dim: dim})
+		}
+	}
 
-	var (
-		res = make(map[string]interface{})
-		tmp = make(map[string][]interface{})
-	)
-	failRet := func() interface{} {
-		res["code"] = 50001
-		res["status"] = "fail"
-		res["data"] = "查询日志失败"
-		return res
+	// 按 domain + 区域并发查询, 单个失败不影响其他结果
+	limiter := tencentLimiter(req.SecretID)
+	taskCh := make(chan *logTask)
+	var wg sync.WaitGroup
+	for i := 0; i < tencentLogWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range taskCh {
+				task.logs, task.err = queryDomainLogs(ctx, client, limiter, task.domain, startTime, endTime, task.dim)
+			}
+		}()
 	}
+	for _, task := range tasks {
+		taskCh <- task
+	}
+	close(taskCh)
+	wg.Wait()
 
+	var (
+		res    = make(map[string]interface{})
+		tmp    = make(map[string][]interface{})
+		errs   = make(map[string]map[string]string)
+		failed = 0
+	)
 	for _, domain := range domains {
-		tmpMainLand := make(map[string]interface{})
-		tmpOverSea := make(map[string]interface{})
-		for _, dim := range dimensions {
-			logs, err := queryDomainLogs(client, domain, startTime, endTime, dim)
-			if err != nil {
-				fmt.Printf("查询日志失败: %v\n", err)
-				return failRet()
-			}
-			fmt.Printf("\n=== 日志下载链接 ===\n")
-			for _, log := range logs {
-				fmt.Printf("日志路径: %s\n区域: %s\n下载地址: %s\n\n",
-					*log.LogPath, *log.Area, *log.LogPath)
-			}
-			if dim == "mainland" {
-				tmpMainLand["mainland"] = logs
-				continue
+		tmp[domain] = append(tmp[domain], make(map[string]interface{}), make(map[string]interface{}))
+	}
+	for _, task := range tasks {
+		if task.err != nil {
+			fmt.Printf("查询日志失败: [domain: %s] [area: %s] %v\n", task.domain, task.dim, task.err)
+			if errs[task.domain] == nil {
+				errs[task.domain] = make(map[string]string)
 			}
-			tmpOverSea["oversea"] = logs
+			errs[task.domain][task.dim] = task.err.Error()
+			failed++
+			continue
+		}
+		if task.dim == "mainland" {
+			tmp[task.domain][0].(map[string]interface{})["mainland"] = task.logs
+			continue
 		}
-		tmp[domain] = append(tmp[domain], tmpMainLand, tmpOverSea)
+		tmp[task.domain][1].(map[string]interface{})["oversea"] = task.logs
 	}
 
+	if len(tasks) > 0 && failed == len(tasks) {
+		res["code"] = 50001
+		res["status"] = "fail"
+		res["data"] = "查询日志失败"
+		res["errors"] = errs
+		return res
+	}
 	res["code"] = 200
 	res["status"] = "success"
+	if failed > 0 {
+		res["status"] = "partial"
+		res["errors"] = errs
+	}
 	res["data"] = tmp
 	return res
 }
 
-func queryDomainLogs(client *cdn.Client, domain, startTime, endTime, dim string) ([]*cdn.DomainLog, error) {
-	req := cdn.NewDescribeCdnDomainLogsRequest()
-	req.Domain = &domain
-	req.StartTime = &startTime
-	req.EndTime = &endTime
-	req.Limit = common.Int64Ptr(1000)
-	req.Area = &dim // mainland-境内 overseas-境外
-	//fmt.Printf("req %+v", req.ToJsonString())
-	resp, err := client.DescribeCdnDomainLogs(req)
-	//fmt.Println("resp", resp.ToJsonString())
-	if err != nil {
-		if sdkErr, ok := err.(*errors.TencentCloudSDKError); ok {
-			return nil, fmt.Errorf("API Error[%s]Mag[%s]Id[%s]", sdkErr.GetCode(), sdkErr.GetMessage(), sdkErr.RequestId)
+// queryDomainLogs 按 Offset 翻页直到取完 TotalCount 条
+func queryDomainLogs(ctx context.Context, client *cdn.Client, limiter *tokenBucket, domain, startTime, endTime, dim string) ([]*cdn.DomainLog, error) {
+	var result []*cdn.DomainLog
+	for {
+		req := cdn.NewDescribeCdnDomainLogsRequest()
+		req.Domain = &domain
+		req.StartTime = &startTime
+		req.EndTime = &endTime
+		req.Offset = common.Int64Ptr(int64(len(result)))
+		req.Limit = common.Int64Ptr(tencentLogPageSize)
+		req.Area = &dim // mainland-境内 overseas-境外
+		if err := limiter.Wait(ctx); err != nil {
+			return result, err
+		}
+		resp, err := client.DescribeCdnDomainLogsWithContext(ctx, req)
+		if err != nil {
+			if sdkErr, ok := err.(*errors.TencentCloudSDKError); ok {
+				return nil, fmt.Errorf("API Error[%s]Mag[%s]Id[%s]", sdkErr.GetCode(), sdkErr.GetMessage(), sdkErr.RequestId)
+			}
+			return nil, err
+		}
+		result = append(result, resp.Response.DomainLogs...)
+		if len(resp.Response.DomainLogs) == 0 || resp.Response.TotalCount == nil || int64(len(result)) >= *resp.Response.TotalCount {
+			return result, nil
 		}
-		return nil, err
 	}
-
-	return resp.Response.DomainLogs, nil
 }
 
 func formatData(reqData []CDNDataResult, originData []CDNDataResult) map[string][]map[string]interface{} {
 	result := make(map[string][]map[string]interface{})
 	domainDataMap := make(map[string]map[string]map[string]map[string]int64)
+	unixTimes := make(map[string]int64)
 
 	// 初始化数据结构
 	// 第一级 domain，第二级时间戳，第三级 DataType (mainland/overseas)，第四级指标名称
@@ -447,6 +444,9 @@ func formatData(reqData []CDNDataResult, originData []CDNDataResult) map[string]
 			if _, exists := domainDataMap[data.Domain][timestamp]; !exists {
 				domainDataMap[data.Domain][timestamp] = make(map[string]map[string]int64)
 			}
+			if i < len(data.Unix) {
+				unixTimes[timestamp] = data.Unix[i]
+			}
 			dataTypeKey := data.DataType
 			if data.DataType == "overseas" && data.Location > 0 {
 				dataTypeKey = fmt.Sprintf("overseas_%d", data.Location)
@@ -493,12 +493,17 @@ func formatData(reqData []CDNDataResult, originData []CDNDataResult) map[string]
 				if len(metricsData) == 0 {
 					continue
 				}
-				t, err := time.Parse("2006-01-02 15:04:05", timestamp)
-				if err != nil {
-					fmt.Printf("解析时间失败: %v\n", err)
-					continue
+				var startTimeMs int64
+				if unix, ok := unixTimes[timestamp]; ok {
+					startTimeMs = unix * 1000
+				} else {
+					t, err := time.ParseInLocation("2006-01-02 15:04:05", timestamp, tencentLogLocation)
+					if err != nil {
+						fmt.Printf("解析时间失败: %v\n", err)
+						continue
+					}
+					startTimeMs = t.UnixNano() / 1e6
 				}
-				startTimeMs := t.UnixNano() / 1e6
 
 				var locationCode = 0
 				var dataType = dataTypeKey
@@ -554,11 +559,12 @@ func formatData(reqData []CDNDataResult, originData []CDNDataResult) map[string]
 	return result
 }
 
+// getRegionByDataType 没有 district 的境外数据无法确定大区, 与 getRegion 未知国家一致归为 other
 func getRegionByDataType(dataType string) string {
 	if dataType == "mainland" {
 		return "mainland_china"
 	}
-	return "mainland_china"
+	return "other"
 }
 
 func getValueOrDefault(metrics map[string]int64, key string, defaultValue int64) int64 {
@@ -569,49 +575,17 @@ func getValueOrDefault(metrics map[string]int64, key string, defaultValue int64)
 }
 
 func getTencentRegion(c int) string {
-	/*
-		// https://cloud.tencent.com/document/product/228/6316#.E5.8C.BA.E5.9F.9F-.2F-.E8.BF.90.E8.90.A5.E5.95.86.E6.98.A0.E5.B0.84.E8.A1.A8
-			中东 (2000000004) → asia
-			亚太一区 (2000000001) → asia
-			亚太二区 (2000000002) → asia
-			亚太三区 (2000000003) → asia
-			北美 (2000000005) → north_america
-			欧洲 (2000000006) → europe
-			南美 (2000000007) → south_america
-			非洲 (2000000008) → africa
-	*/
-	region := map[int]string{
-		2000000004: "asia",
-		2000000001: "asia",
-		2000000002: "asia",
-		2000000003: "asia",
-		2000000005: "north_america",
-		2000000006: "europe",
-		2000000007: "south_america",
-		2000000008: "africa",
-		//  新加坡 (1176)
-		1176: "asia",
-		// 印度尼西亚 (1195)
-		1195: "asia",
-		// "IN": "asia", // 印度 (73)
-		73: "asia",
-	}
 	if c == 0 {
 		return "asia"
 	}
-	return region[c]
+	return tencentConf.byCode[c].Region
 }
 
 func getTencentCountry(c int) string {
-	cmap := map[int]string{
-		1176: "sg", // 新加坡 (1176)
-		1195: "id", // 印度尼西亚 (1195)
-		73:   "in", // 印度 (73)
-	}
 	if c == 0 {
-		return "unkonw"
+		return "unknown"
 	}
-	return cmap[c]
+	return tencentConf.byCode[c].Country
 }
 
 func getCountry(dataType string, location int) string {
@@ -628,6 +602,7 @@ func SplitDomains(input string) []string {
 	return strings.Split(input, ",")
 }
 
+// GetTimeStr 腾讯云接口的时间参数和返回的时间都是东八区, 与服务器时区无关
 func GetTimeStr(t int64) string {
-	return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+	return time.Unix(t, 0).In(tencentLogLocation).Format("2006-01-02 15:04:05")
 }
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	cdn "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cdn/v20180606"
+)
+
+// fakeTencentLogServer 模拟 DescribeCdnDomainLogs: 每个 domain+区域共 total 条, 按 Offset/Limit 分页;
+// failDomain 的 overseas 区域返回 API 错误
+func fakeTencentLogServer(t *testing.T, total int, failDomain string) (*httptest.Server, *[]int64) {
+	var (
+		mu      sync.Mutex
+		offsets []int64
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Domain string
+			Area   string
+			Offset int64
+			Limit  int64
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("解析请求失败: %v", err)
+		}
+		if req.Domain == failDomain && req.Area == "overseas" {
+			fmt.Fprint(w, `{"Response":{"Error":{"Code":"InternalError","Message":"boom"},"RequestId":"r1"}}`)
+			return
+		}
+		mu.Lock()
+		if req.Domain == "a.com" && req.Area == "mainland" {
+			offsets = append(offsets, req.Offset)
+		}
+		mu.Unlock()
+		var logs []string
+		for i := req.Offset; i < req.Offset+req.Limit && i < int64(total); i++ {
+			logs = append(logs, fmt.Sprintf(`{"LogName":"%s-%d","LogPath":"http://logs/%s/%s/%d.gz","Area":%q}`, req.Domain, i, req.Domain, req.Area, i, req.Area))
+		}
+		fmt.Fprintf(w, `{"Response":{"DomainLogs":[%s],"TotalCount":%d,"RequestId":"r1"}}`, strings.Join(logs, ","), total)
+	}))
+	return srv, &offsets
+}
+
+func TestGetLog(t *testing.T) {
+	total := 2*tencentLogPageSize + 500
+	srv, offsets := fakeTencentLogServer(t, total, "bad.com")
+	defer srv.Close()
+
+	res := GetLog(context.Background(), reqForTencentLog{
+		SecretID: "get-log-test", SecretKey: "k", Domains: "a.com,bad.com", EndPoint: srv.URL, StartTime: 1704067200, EndTime: 1704070800,
+	}).(map[string]interface{})
+
+	if res["code"] != 200 || res["status"] != "partial" {
+		t.Fatalf("code=%v status=%v", res["code"], res["status"])
+	}
+	if want := []int64{0, tencentLogPageSize, 2 * tencentLogPageSize}; fmt.Sprint(*offsets) != fmt.Sprint(want) {
+		t.Fatalf("Offset 依次为 %v, 期望 %v", *offsets, want)
+	}
+	data := res["data"].(map[string][]interface{})
+	for _, domain := range []string{"a.com", "bad.com"} {
+		mainland := data[domain][0].(map[string]interface{})["mainland"].([]*cdn.DomainLog)
+		if len(mainland) != total || *mainland[total-1].LogName != fmt.Sprintf("%s-%d", domain, total-1) {
+			t.Fatalf("%s 境内日志 %d 条, 期望 %d 条", domain, len(mainland), total)
+		}
+	}
+	if oversea := data["a.com"][1].(map[string]interface{})["oversea"].([]*cdn.DomainLog); len(oversea) != total {
+		t.Fatalf("a.com 境外日志 %d 条", len(oversea))
+	}
+	// 单个 domain+区域失败只记录在 errors 中, 不影响其他结果
+	errs := res["errors"].(map[string]map[string]string)
+	if len(errs) != 1 || !strings.Contains(errs["bad.com"]["overseas"], "InternalError") {
+		t.Fatalf("errors 为 %v", errs)
+	}
+	if _, ok := data["bad.com"][1].(map[string]interface{})["oversea"]; ok {
+		t.Fatal("失败的区域不应返回数据")
+	}
+}
+
+func TestHandleTencentZipLog(t *testing.T) {
+	srv, _ := fakeTencentLogServer(t, 3, "")
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		wantCode   int
+		wantStatus string
+	}{
+		{name: "无效的 JSON", body: "{", wantCode: http.StatusBadRequest},
+		{
+			name:       "查询成功",
+			body:       fmt.Sprintf(`{"secretId":"zip-log-test","secretKey":"k","domains":"a.com","startTime":1704067200,"endTime":1704070800,"endPoint":%q}`, srv.URL),
+			wantCode:   http.StatusOK,
+			wantStatus: "success",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleTencentZipLog(w, httptest.NewRequest(http.MethodPost, "/tencent/zipLog", strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Fatalf("状态码 %d, 期望 %d", w.Code, tt.wantCode)
+			}
+			if tt.wantStatus == "" {
+				if strings.Contains(w.Body.String(), `"code"`) {
+					t.Fatalf("参数错误后不应继续查询: %s", w.Body.String())
+				}
+				return
+			}
+			var res struct {
+				Code   int    `json:"code"`
+				Status string `json:"status"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Status != tt.wantStatus {
+				t.Fatalf("响应 %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestFormatDataTeo(t *testing.T) {
+	// EdgeOne 返回 unix 秒; 境外数据没有 district
+	data := []CDNDataResult{
+		{Domain: "a.com", DataType: "mainland", Metric: "flux", Timestamps: []string{"1704067200"}, Unix: []int64{1704067200}, Values: []int64{100}},
+		{Domain: "a.com", DataType: "overseas", Metric: "flux", Timestamps: []string{"1704067200"}, Unix: []int64{1704067200}, Values: []int64{50}},
+	}
+	got := map[string]map[string]interface{}{}
+	for _, record := range formatData(data, nil)["a.com"] {
+		got[record["country"].(string)] = record
+	}
+	tests := []struct {
+		country string
+		region  string
+		flux    int64
+	}{
+		{country: "cn", region: "mainland_china", flux: 100},
+		{country: "unknown", region: "other", flux: 50},
+	}
+	for _, tt := range tests {
+		record, ok := got[tt.country]
+		if !ok {
+			t.Fatalf("缺少 %s 的记录: %v", tt.country, got)
+		}
+		if record["start_time"] != int64(1704067200000) || record["region"] != tt.region || record["flux"] != tt.flux {
+			t.Fatalf("%s 的记录为 %v", tt.country, record)
+		}
+	}
+}
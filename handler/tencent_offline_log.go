@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"bufio"
+	"cf_logpush/dto"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 腾讯云 CDN 离线日志时间为东八区, 格式 20060102150405
+var tencentLogLocation = time.FixedZone("UTC+8", 8*3600)
+
+var tencentLogClient = newRetryHTTPClient("tencent-log", 10*time.Minute, defaultRetryPolicy, nil)
+
+// tencentLogFileReport 单个日志文件的转换结果, SHA256 为下载文件的校验和 (gzip 文件为解压前的内容), Bytes 为下载的字节数
+type tencentLogFileReport struct {
+	Domain  string `json:"domain"`
+	Area    string `json:"area"`
+	LogName string `json:"logName"`
+	URL     string `json:"url"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+	Lines   int    `json:"lines"`
+	Written int    `json:"written"`
+	Skipped int    `json:"skipped"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HandleTencentConvertLog 创建离线日志转换任务: 查询下载地址, 下载并转换为离线日志格式写入 LogPath;
+// 下载耗时较长, 通过任务管理异步执行, 进度和结果分别用 /tencent/jobs?id= 和 /tencent/jobs/result?id= 查询
+func HandleTencentConvertLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅支持 POST 方法", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 32<<20)
+	defer r.Body.Close()
+	req := reqForTencentLog{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("无效的 JSON 数据: %s\n", err.Error())
+		http.Error(w, "无效的 JSON 数据", http.StatusBadRequest)
+		return
+	}
+	if req.SecretID == "" || req.SecretKey == "" || req.Domains == "" || req.StartTime == 0 || req.EndTime == 0 {
+		http.Error(w, "缺少必要参数: secretId, secretKey, domains, startTime, endTime", http.StatusBadRequest)
+		return
+	}
+
+	StartTencentJobs()
+	job := tencentJobs.createConvert(req)
+	writeJobResponse(w, http.StatusOK, map[string]interface{}{"id": job.ID, "kind": job.Kind})
+}
+
+// convertTencentLogURL 下载一个日志文件, 逐行解析后通过 WriteToFile 写入, 失败信息记录在 Error 中
+func convertTencentLogURL(ctx context.Context, u string) tencentLogFileReport {
+	report := tencentLogFileReport{URL: u}
+	fail := func(err error) tencentLogFileReport {
+		report.Error = err.Error()
+		log.Printf("### tencent-log ### [url: %s] 转换失败: %v\n", u, err)
+		return report
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fail(err)
+	}
+	resp, err := tencentLogClient.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("请求返回非200状态码: %d", resp.StatusCode))
+	}
+
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(resp.Body, hash)}
+	br := bufio.NewReader(counter)
+	var reader io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(br)
+		if err != nil {
+			return fail(fmt.Errorf("创建 gzip 解压缩器时出错: %v", err))
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		report.Lines++
+		l, err := parseTencentLogLine(line)
+		if err != nil {
+			report.Skipped++
+			continue
+		}
+		WriteToFile(l)
+		report.Written++
+	}
+	if err := scanner.Err(); err != nil {
+		return fail(err)
+	}
+	// 读完剩余内容, 保证校验和覆盖整个文件
+	io.Copy(io.Discard, counter)
+	report.Bytes = counter.n
+	report.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	fmt.Println("### tencent-log ###", "[url: "+u+"]", fmt.Sprintf("[lines: %d] [written: %d] [skipped: %d] [sha256: %s]",
+		report.Lines, report.Written, report.Skipped, report.SHA256))
+	return report
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseTencentLogLine 解析腾讯云 CDN 离线日志, 字段以空格分隔, 带空格的字段用双引号包裹:
+// 请求时间 客户端IP 域名 路径 字节数 省份 运营商 状态码 Referer 耗时(ms) UA Range 方法 协议 Hit/Miss 客户端端口
+func parseTencentLogLine(line string) (dto.InputLogForDownLoad, error) {
+	var l dto.InputLogForDownLoad
+	fields := splitTencentLogFields(line)
+	if len(fields) < 15 {
+		return l, fmt.Errorf("字段数不足: %d", len(fields))
+	}
+	t, err := time.ParseInLocation("20060102150405", fields[0], tencentLogLocation)
+	if err != nil {
+		return l, err
+	}
+	bytes, _ := strconv.Atoi(fields[4])
+	status, err := strconv.Atoi(fields[7])
+	if err != nil {
+		return l, fmt.Errorf("无效的状态码: %s", fields[7])
+	}
+	requestTime, _ := strconv.Atoi(fields[9])
+
+	l.EdgeStartTimestamp = t.UTC().Format(time.RFC3339)
+	l.EdgeEndTimestamp = t.Add(time.Duration(requestTime) * time.Millisecond).UTC().Format(time.RFC3339)
+	l.ClientIP = fields[1]
+	l.ClientRequestHost = fields[2]
+	l.ClientRequestURI = fields[3]
+	l.EdgeResponseBytes = bytes
+	l.EdgeResponseBodyBytes = bytes
+	l.EdgeResponseStatus = status
+	l.ClientRequestReferer = tencentLogValue(fields[8])
+	l.ClientRequestUserAgent = tencentLogValue(fields[10])
+	l.ClientRequestMethod = fields[12]
+	l.ClientRequestProtocol = fields[13]
+	l.CacheCacheStatus = strings.ToLower(fields[14])
+	if len(fields) > 15 {
+		l.ClientSrcPort, _ = strconv.Atoi(fields[15])
+	}
+	return l, nil
+}
+
+func tencentLogValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+func splitTencentLogFields(line string) []string {
+	var fields []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+		if line[i] == '"' {
+			end := strings.IndexByte(line[i+1:], '"')
+			if end < 0 {
+				fields = append(fields, line[i+1:])
+				break
+			}
+			fields = append(fields, line[i+1:i+1+end])
+			i += end + 2
+			continue
+		}
+		end := strings.IndexByte(line[i:], ' ')
+		if end < 0 {
+			fields = append(fields, line[i:])
+			break
+		}
+		fields = append(fields, line[i:i+end])
+		i += end
+	}
+	return fields
+}
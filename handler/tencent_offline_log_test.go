@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"bytes"
+	"cf_logpush/dto"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tencentTestLog = `20240101080000 1.2.3.4 a.com /x.jpg 1234 22 2 200 - 30 "Mozilla/5.0 (X11)" "-" GET HTTP/1.1 hit 5555
+bad line
+
+20240101080100 1.2.3.5 a.com /y.jpg 10 22 2 404 "https://ref/" 5 "curl/8.0" "-" GET HTTP/2.0 miss 6666
+`
+
+// tencentTestFiles 离线日志文件服务: /plain.log 为原文, /gzip.log.gz 为 gzip 压缩后的内容
+func tencentTestFiles(t *testing.T) (*httptest.Server, map[string][]byte) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(tencentTestLog))
+	zw.Close()
+	files := map[string][]byte{
+		"/plain.log":   []byte(tencentTestLog),
+		"/gzip.log.gz": buf.Bytes(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	return srv, files
+}
+
+func useTestLogPath(t *testing.T) string {
+	old := dto.LogPath
+	dto.LogPath = t.TempDir()
+	SetLogWriteBlocking(true)
+	t.Cleanup(func() {
+		FlushLogs()
+		dto.LogPath = old
+		SetLogWriteBlocking(false)
+	})
+	return dto.LogPath
+}
+
+func TestConvertTencentLogURL(t *testing.T) {
+	logPath := useTestLogPath(t)
+	srv, files := tencentTestFiles(t)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "未压缩", path: "/plain.log"},
+		{name: "gzip 压缩", path: "/gzip.log.gz"},
+		{name: "文件不存在", path: "/missing.log", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := convertTencentLogURL(context.Background(), srv.URL+tt.path)
+			if tt.wantErr {
+				if report.Error == "" || report.Written != 0 {
+					t.Fatalf("期望错误, 得到 %+v", report)
+				}
+				return
+			}
+			sum := sha256.Sum256(files[tt.path])
+			if report.Error != "" || report.Lines != 3 || report.Written != 2 || report.Skipped != 1 {
+				t.Fatalf("得到 %+v, 期望 lines=3 written=2 skipped=1", report)
+			}
+			if report.SHA256 != hex.EncodeToString(sum[:]) || report.Bytes != int64(len(files[tt.path])) {
+				t.Fatalf("校验和/字节数为 %s/%d, 期望 %x/%d", report.SHA256, report.Bytes, sum, len(files[tt.path]))
+			}
+		})
+	}
+
+	FlushLogs()
+	data, err := os.ReadFile(filepath.Join(logPath, "20240101", "202401010800-a.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 两个文件各写入 2 行
+	if n := strings.Count(string(data), "\n"); n != 4 {
+		t.Fatalf("离线日志 %d 行, 期望 4 行:\n%s", n, data)
+	}
+}
+
+func TestHandleTencentConvertLog(t *testing.T) {
+	useTestLogPath(t)
+	t.Setenv("TENCENT_JOB_DIR", t.TempDir())
+	files, _ := tencentTestFiles(t)
+	defer files.Close()
+	// 模拟 DescribeCdnDomainLogs: 境内返回两个文件, 其中一个不存在; 境外返回 API 错误
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Area string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Area == "overseas" {
+			fmt.Fprint(w, `{"Response":{"Error":{"Code":"InternalError","Message":"boom"},"RequestId":"r1"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"Response":{"DomainLogs":[{"LogName":"gzip","LogPath":"%s/gzip.log.gz"},{"LogName":"missing","LogPath":"%s/missing.log"}],"TotalCount":2,"RequestId":"r1"}}`, files.URL, files.URL)
+	}))
+	defer api.Close()
+
+	w := httptest.NewRecorder()
+	HandleTencentConvertLog(w, httptest.NewRequest(http.MethodPost, "/tencent/convertLog", strings.NewReader(
+		fmt.Sprintf(`{"secretId":"convert-test","secretKey":"k","domains":"a.com","startTime":1704067200,"endTime":1704070800,"endPoint":%q}`, api.URL))))
+	var created struct {
+		Data struct {
+			ID   string `json:"id"`
+			Kind string `json:"kind"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusOK || created.Data.ID == "" || created.Data.Kind != tencentJobKindConvert {
+		t.Fatalf("创建任务返回 %d %s", w.Code, w.Body.String())
+	}
+
+	var job tencentJob
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		job, _ = tencentJobs.get(created.Data.ID)
+		if job.FinishedAt != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("任务未结束: %+v", job)
+		}
+	}
+	if job.Status != tencentJobDone || job.Total != 2 || job.Done != 2 || job.Failed != 2 || len(job.Domain["a.com"].Errors) != 2 {
+		t.Fatalf("任务状态 %+v %+v", job, job.Domain["a.com"])
+	}
+
+	data, err := os.ReadFile(tencentJobs.resultPath(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []tencentLogFileReport
+	if err := json.Unmarshal(data, &reports); err != nil || len(reports) != 3 {
+		t.Fatalf("任务结果 %s", data)
+	}
+	got := map[string]tencentLogFileReport{}
+	for _, report := range reports {
+		got[report.Area+"/"+report.LogName] = report
+	}
+	if r := got["mainland/gzip"]; r.Written != 2 || r.Error != "" {
+		t.Fatalf("gzip 文件结果 %+v", r)
+	}
+	if got["mainland/missing"].Error == "" || !strings.Contains(got["overseas/"].Error, "InternalError") {
+		t.Fatalf("失败的文件和区域应记录错误: %s", data)
+	}
+}
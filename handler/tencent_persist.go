@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"cf_logpush/dto"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// 腾讯云 DescribeCdnData 按 min 粒度查询
+const tencentInterval = 60
+
+type tencentPollerConfig struct {
+	Request     reqForTencentLog
+	Interval    time.Duration
+	Lag         time.Duration
+	MaxBackfill time.Duration
+	Checkpoint  string
+	Sinks       []string
+}
+
+type tencentPollCheckpoint struct {
+	LastEnd   int64 `json:"last_end"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+var (
+	tencentPollerOnce sync.Once
+)
+
+// tencentPersistSinks 落库目标, 与 CF_POLL_SINKS 取值相同, 默认只写 ES
+func tencentPersistSinks() []string {
+	sinks := os.Getenv("TENCENT_PERSIST_SINKS")
+	if sinks == "" {
+		sinks = cfPollSinkES
+	}
+	var result []string
+	for _, sink := range strings.Split(sinks, ",") {
+		if sink = strings.TrimSpace(sink); sink != "" {
+			result = append(result, sink)
+		}
+	}
+	return result
+}
+
+func loadTencentPollerConfig() tencentPollerConfig {
+	conf := tencentPollerConfig{
+		Request: reqForTencentLog{
+			SecretID:  os.Getenv("TENCENT_POLL_SECRET_ID"),
+			SecretKey: os.Getenv("TENCENT_POLL_SECRET_KEY"),
+			Domains:   os.Getenv("TENCENT_POLL_DOMAINS"),
+			EndPoint:  os.Getenv("TENCENT_POLL_ENDPOINT"),
+			TenantId:  os.Getenv("TENCENT_POLL_TENANT"),
+		},
+		Interval:    envMinutes("TENCENT_POLL_INTERVAL_MIN", 5),
+		Lag:         envMinutes("TENCENT_POLL_LAG_MIN", 10),
+		MaxBackfill: time.Duration(envInt("TENCENT_POLL_MAX_BACKFILL_HOURS", 24)) * time.Hour,
+		Checkpoint:  os.Getenv("TENCENT_POLL_CHECKPOINT"),
+		Sinks:       tencentPersistSinks(),
+	}
+	if conf.Request.EndPoint == "" {
+		conf.Request.EndPoint = "cdn.tencentcloudapi.com"
+	}
+	if conf.Checkpoint == "" {
+		conf.Checkpoint = filepath.Join(dto.LogPath, ".tencent_checkpoint.json")
+	}
+	return conf
+}
+
+// StartTencentPoller 配置了 TENCENT_POLL_DOMAINS 时定时拉取腾讯云统计数据并落库
+func StartTencentPoller() {
+	tencentPollerOnce.Do(func() {
+		conf := loadTencentPollerConfig()
+		if conf.Request.Domains == "" || conf.Request.SecretID == "" {
+			return
+		}
+		log.Printf("### tencent-poller ### 启动, domains: %s, interval: %v, lag: %v, sinks: %v\n",
+			conf.Request.Domains, conf.Interval, conf.Lag, conf.Sinks)
+		go func() {
+			ticker := time.NewTicker(conf.Interval)
+			defer ticker.Stop()
+			for {
+				pollTencent(conf)
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+func pollTencent(conf tencentPollerConfig) {
+	end := time.Now().Add(-conf.Lag).Truncate(time.Minute)
+	start := end.Add(-conf.Interval)
+
+	var cp tencentPollCheckpoint
+	if data, err := os.ReadFile(conf.Checkpoint); err == nil {
+		if err := json.Unmarshal(data, &cp); err != nil {
+			log.Printf("### tencent-poller ### 读取 checkpoint 失败: %v\n", err)
+		} else if cp.LastEnd > 0 {
+			start = time.Unix(cp.LastEnd, 0)
+		}
+	}
+	if end.Sub(start) > conf.MaxBackfill {
+		log.Printf("### tencent-poller ### 缺口超过 %v, 丢弃 %s 至 %s 的数据\n",
+			conf.MaxBackfill, start.Format(time.RFC3339), end.Add(-conf.MaxBackfill).Format(time.RFC3339))
+		start = end.Add(-conf.MaxBackfill)
+	}
+	if !start.Before(end) {
+		return
+	}
+
+	written, err := fetchAndPersistTencent(conf, conf.Sinks, start, end)
+	if err != nil {
+		log.Printf("### tencent-poller ### [startTime: %s] [endTime: %s] %v, 下次重试\n",
+			start.Format(time.RFC3339), end.Format(time.RFC3339), err)
+		return
+	}
+	fmt.Println("### tencent-poller ###", "[startTime: "+start.Format(time.RFC3339)+"] [endTime: "+end.Format(time.RFC3339)+"]", fmt.Sprintf("[records: %d]", written))
+
+	data, _ := json.Marshal(tencentPollCheckpoint{LastEnd: end.Unix(), UpdatedAt: time.Now().Unix()})
+	if err := writeFileAtomic(conf.Checkpoint, data); err != nil {
+		log.Printf("### tencent-poller ### 保存 checkpoint 失败: %v\n", err)
+	}
+}
+
+// fetchAndPersistTencent 拉取 [start, end) 的统计数据并写入 sinks, 任一查询失败时不落库
+func fetchAndPersistTencent(conf tencentPollerConfig, sinks []string, start, end time.Time) (int, error) {
+	// DescribeCdnData 的 EndTime 包含该分钟, 这里查询 [start, end-1min]
+	req := conf.Request
+	req.StartTime = start.Unix()
+	req.EndTime = end.Add(-time.Minute).Unix()
+	client := newTencentCdnClient(req, "ap-shanghai")
+	results := runTencentTasks(context.Background(), req, client, buildTencentMetricTasks(SplitDomains(req.Domains)), nil)
+	for _, res := range results {
+		if res.Err != nil {
+			return 0, fmt.Errorf("存在查询失败: %v", res.Err)
+		}
+	}
+	dataResults, dataOriginResults := splitTencentResults(results)
+	written, err := persistTencentData(sinks, req.TenantId, formatData(dataResults, dataOriginResults))
+	if err != nil {
+		return written, fmt.Errorf("落库失败: %v", err)
+	}
+	return written, nil
+}
+
+// RunTencentRepair 修复时间解析修正前落库的数据
+//
+//	cf_logpush tencent-repair -start 1700000000 -end 1700086400 [-dry-run]
+//
+// 修正前腾讯云的东八区时间被当作 UTC 解析, [start, end) 的数据以 +8 小时的 start_time 和文档 ID 写入,
+// 无法按原 ID 覆盖. 这里删除 TENCENT_POLL_TENANT 下 TENCENT_POLL_DOMAINS 在 [start, end+8h) 的全部文档,
+// 再按正确时间重新拉取同一范围, 只写 ES
+func RunTencentRepair(args []string) error {
+	fs := flag.NewFlagSet("tencent-repair", flag.ContinueOnError)
+	startUnix := fs.Int64("start", 0, "受影响数据的起始时间 (unix 秒)")
+	endUnix := fs.Int64("end", 0, "受影响数据的结束时间 (unix 秒)")
+	dryRun := fs.Bool("dry-run", false, "只统计要删除的文档数")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	conf := loadTencentPollerConfig()
+	if conf.Request.Domains == "" || conf.Request.SecretID == "" || conf.Request.TenantId == "" {
+		return fmt.Errorf("需要配置 TENCENT_POLL_SECRET_ID, TENCENT_POLL_DOMAINS 和 TENCENT_POLL_TENANT")
+	}
+	if *startUnix <= 0 || *endUnix <= *startUnix {
+		return fmt.Errorf("-start 和 -end 必须为 unix 秒且 end 大于 start")
+	}
+	if esClient == nil {
+		return fmt.Errorf("ES 客户端未初始化")
+	}
+	start := time.Unix(*startUnix, 0).Truncate(time.Minute)
+	end := time.Unix(*endUnix, 0).Add(8 * time.Hour)
+	if latest := time.Now().Add(-conf.Lag).Truncate(time.Minute); end.After(latest) {
+		end = latest
+	}
+
+	var domains []interface{}
+	for _, domain := range SplitDomains(conf.Request.Domains) {
+		domains = append(domains, domain)
+	}
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("t", conf.Request.TenantId),
+		elastic.NewTermsQuery("d", domains...),
+		elastic.NewRangeQuery("start_time").Gte(start.Unix()).Lt(end.Unix()).Format("epoch_second"),
+	)
+	ctx := context.Background()
+	count, err := esClient.Count(esStatisticalPrefix).IgnoreUnavailable(true).Query(query).Do(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[tencent-repair] %s 至 %s 共 %d 条文档\n", start.Format(time.RFC3339), end.Format(time.RFC3339), count)
+	if *dryRun {
+		return nil
+	}
+	res, err := esClient.DeleteByQuery(esStatisticalPrefix).IgnoreUnavailable(true).Query(query).Refresh("true").Do(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[tencent-repair] 已删除 %d 条\n", res.Deleted)
+
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(conf.Interval) {
+		chunkEnd := chunkStart.Add(conf.Interval)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		written, err := fetchAndPersistTencent(conf, []string{cfPollSinkES}, chunkStart, chunkEnd)
+		if err != nil {
+			return fmt.Errorf("[startTime: %s] %v, 可从该时间重新执行", chunkStart.Format(time.RFC3339), err)
+		}
+		fmt.Printf("[tencent-repair] [startTime: %s] [endTime: %s] [records: %d]\n",
+			chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), written)
+	}
+	return nil
+}
+
+// persistTencentData 把 formatData 的结果按 sinks 写入, ES 使用确定性文档 ID, 重复拉取同一分钟时覆盖
+func persistTencentData(sinks []string, tenantId string, data map[string][]map[string]interface{}) (int, error) {
+	written := 0
+	for _, records := range data {
+		for _, record := range records {
+			d := tencentRecordToDTO(tenantId, record)
+			for _, sink := range sinks {
+				switch sink {
+				case cfPollSinkTDAgent:
+					outputJSON, err := json.Marshal(d)
+					if err != nil {
+						return written, err
+					}
+					if err := SendToTDAgent(string(outputJSON)); err != nil {
+						return written, err
+					}
+				case cfPollSinkES:
+					if err := sendToESWithInterval(d, StatisticalData, tencentInterval); err != nil {
+						return written, err
+					}
+				default:
+					return written, fmt.Errorf("未知的 sink: %s", sink)
+				}
+			}
+			written++
+		}
+	}
+	return written, nil
+}
+
+func tencentRecordToDTO(tenantId string, record map[string]interface{}) dto.OutputLog {
+	num := func(key string) int {
+		switch v := record[key].(type) {
+		case int64:
+			return int(v)
+		case int:
+			return v
+		case float64:
+			return int(v)
+		}
+		return 0
+	}
+	str := func(key string) string {
+		s, _ := record[key].(string)
+		return s
+	}
+	startTime := int64(num("start_time"))
+	return dto.OutputLog{
+		StartTime:     startTime,
+		Country:       str("country"),
+		Region:        str("region"),
+		Domain:        str("domain"),
+		BW:            num("bw"),
+		Flux:          num("flux"),
+		BSBW:          num("bs_bw"),
+		BSFlux:        num("bs_flux"),
+		ReqNum:        num("req_num"),
+		HitNum:        num("hit_num"),
+		BSNum:         num("bs_num"),
+		BSFailNum:     num("bs_fail_num"),
+		HitFlux:       num("hit_flux"),
+		HTTPCode2XX:   num("http_code_2xx"),
+		HTTPCode3XX:   num("http_code_3xx"),
+		HTTPCode4XX:   num("http_code_4xx"),
+		HTTPCode5XX:   num("http_code_5xx"),
+		BSHTTPCode2XX: num("bs_http_code_2xx"),
+		BSHTTPCode3XX: num("bs_http_code_3xx"),
+		BSHTTPCode4XX: num("bs_http_code_4xx"),
+		BSHTTPCode5XX: num("bs_http_code_5xx"),
+		TenantId:      tenantId,
+		TimeLocal:     startTime,
+	}
+}
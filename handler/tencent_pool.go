@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	cdn "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cdn/v20180606"
+	tcerr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+)
+
+const (
+	tencentTaskCdn    = "cdn"
+	tencentTaskOrigin = "origin"
+)
+
+var (
+	tencentWorkers = envInt("TENCENT_WORKERS", 8)
+	tencentQPS     = envInt("TENCENT_QPS", 10)
+
+	// 离线日志查询的并发数, 设为 1 时顺序查询
+	tencentLogWorkers = envInt("TENCENT_LOG_WORKERS", 4)
+)
+
+const tencentLogPageSize = 1000
+
+type tencentQueryTask struct {
+	Kind     string
+	Metric   string
+	Domain   string
+	DataType string
+	District int
+}
+
+type tencentTaskResult struct {
+	Task    tencentQueryTask
+	Results []CDNDataResult
+	Raw     json.RawMessage
+	Err     error
+}
+
+// tencentLimiter 同一 SecretId 的所有请求共享一个令牌桶
+func tencentLimiter(secretId string) *tokenBucket {
+	return accountLimiter("tencent:"+secretId, float64(tencentQPS), tencentQPS)
+}
+
+func isTencentRateLimited(err error) bool {
+	var sdkErr *tcerr.TencentCloudSDKError
+	return errors.As(err, &sdkErr) && strings.HasPrefix(sdkErr.GetCode(), "RequestLimitExceeded")
+}
+
+// runTencentTasks 用固定数量的 worker 执行查询, 每次请求前从令牌桶取令牌, 限频错误按退避重试;
+// ctx 取消后未执行的任务直接返回 ctx 错误. onDone 可为空, 每完成一个任务回调一次
+func runTencentTasks(ctx context.Context, param reqForTencentLog, client *cdn.Client, tasks []tencentQueryTask, onDone func(tencentTaskResult)) []tencentTaskResult {
+	limiter := tencentLimiter(param.SecretID)
+	taskCh := make(chan int)
+	results := make([]tencentTaskResult, len(tasks))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < tencentWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range taskCh {
+				res := runTencentTask(ctx, param, client, limiter, tasks[idx])
+				results[idx] = res
+				if onDone != nil {
+					mu.Lock()
+					onDone(res)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for idx := range tasks {
+		select {
+		case taskCh <- idx:
+		case <-ctx.Done():
+			results[idx] = tencentTaskResult{Task: tasks[idx], Err: ctx.Err()}
+		}
+	}
+	close(taskCh)
+	wg.Wait()
+	return results
+}
+
+func runTencentTask(ctx context.Context, param reqForTencentLog, client *cdn.Client, limiter *tokenBucket, task tencentQueryTask) tencentTaskResult {
+	res := tencentTaskResult{Task: task}
+	for attempt := 1; attempt <= defaultRetryPolicy.MaxAttempts; attempt++ {
+		if res.Err = limiter.Wait(ctx); res.Err != nil {
+			return res
+		}
+		switch task.Kind {
+		case tencentTaskOrigin:
+			res.Results, res.Raw, res.Err = queryDimensionOriginData(ctx, param, client, task.Metric, task.Domain, task.DataType)
+		default:
+			res.Results, res.Raw, res.Err = queryDimensionData(ctx, param, client, task.Metric, task.Domain, task.DataType, task.District)
+		}
+		if res.Err == nil || !isTencentRateLimited(res.Err) || attempt == defaultRetryPolicy.MaxAttempts {
+			break
+		}
+		if err := sleepCtx(ctx, defaultRetryPolicy.Backoff(attempt)); err != nil {
+			res.Err = err
+			break
+		}
+	}
+	if res.Err != nil {
+		fmt.Printf("### tencent ### [domain: %s] [metric: %s] [area: %s] [district: %d] 查询失败: %v\n",
+			task.Domain, task.Metric, task.DataType, task.District, res.Err)
+	}
+	return res
+}
@@ -0,0 +1,356 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	errors1 "errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	errors "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+	tchttp "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/http"
+)
+
+// EdgeOne (teo 2022-09-01) 接口, 只用到两个 Action, 参照 DescribeOriginData 的方式自行定义请求和响应
+const (
+	teoService    = "teo"
+	teoAPIVersion = "2022-09-01"
+	teoEndpoint   = "teo.tencentcloudapi.com"
+)
+
+type teoQueryCondition struct {
+	Key      *string   `json:"Key,omitempty" name:"Key"`
+	Operator *string   `json:"Operator,omitempty" name:"Operator"`
+	Value    []*string `json:"Value,omitempty" name:"Value"`
+}
+
+type DescribeTimingL7AnalysisDataRequest struct {
+	*tchttp.BaseRequest
+	StartTime   *string              `json:"StartTime,omitempty" name:"StartTime"`
+	EndTime     *string              `json:"EndTime,omitempty" name:"EndTime"`
+	MetricNames []*string            `json:"MetricNames,omitempty" name:"MetricNames"`
+	ZoneIds     []*string            `json:"ZoneIds,omitempty" name:"ZoneIds"`
+	Interval    *string              `json:"Interval,omitempty" name:"Interval"`
+	Filters     []*teoQueryCondition `json:"Filters,omitempty" name:"Filters"`
+	Area        *string              `json:"Area,omitempty" name:"Area"`
+}
+
+// 数值字段统一按 float64 解析, 兼容 SDK 不同版本中整型/浮点的差异
+type teoTimingDataItem struct {
+	Timestamp int64   `json:"Timestamp"`
+	Value     float64 `json:"Value"`
+}
+
+type teoTimingTypeValue struct {
+	MetricName string              `json:"MetricName"`
+	Sum        float64             `json:"Sum"`
+	Detail     []teoTimingDataItem `json:"Detail"`
+}
+
+type teoTimingDataRecord struct {
+	TypeKey   string               `json:"TypeKey"`
+	TypeValue []teoTimingTypeValue `json:"TypeValue"`
+}
+
+type DescribeTimingL7AnalysisDataResponse struct {
+	*tchttp.BaseResponse
+	Response *struct {
+		Data       []teoTimingDataRecord `json:"Data"`
+		TotalCount int64                 `json:"TotalCount"`
+		RequestId  *string               `json:"RequestId"`
+	} `json:"Response"`
+}
+
+type DownloadL7LogsRequest struct {
+	*tchttp.BaseRequest
+	StartTime *string   `json:"StartTime,omitempty" name:"StartTime"`
+	EndTime   *string   `json:"EndTime,omitempty" name:"EndTime"`
+	ZoneIds   []*string `json:"ZoneIds,omitempty" name:"ZoneIds"`
+	Domains   []*string `json:"Domains,omitempty" name:"Domains"`
+	Limit     *int64    `json:"Limit,omitempty" name:"Limit"`
+	Offset    *int64    `json:"Offset,omitempty" name:"Offset"`
+}
+
+type teoL7OfflineLog struct {
+	Domain        string `json:"Domain"`
+	Area          string `json:"Area"`
+	LogPacketName string `json:"LogPacketName"`
+	Url           string `json:"Url"`
+	LogTime       int64  `json:"LogTime"`
+	LogStartTime  string `json:"LogStartTime"`
+	LogEndTime    string `json:"LogEndTime"`
+	Size          int64  `json:"Size"`
+}
+
+type DownloadL7LogsResponse struct {
+	*tchttp.BaseResponse
+	Response *struct {
+		Data       []teoL7OfflineLog `json:"Data"`
+		TotalCount int64             `json:"TotalCount"`
+		RequestId  *string           `json:"RequestId"`
+	} `json:"Response"`
+}
+
+func newTeoClient(req reqForTencentLog) *common.Client {
+	endpoint := req.EndPoint
+	if endpoint == "" {
+		endpoint = teoEndpoint
+	}
+	client := &common.Client{}
+	client.Init("").WithCredential(common.NewCredential(req.SecretID, req.SecretKey)).WithProfile(tencentClientProfile(endpoint)).WithHttpTransport(tencentTransport)
+	return client
+}
+
+func NewDescribeTimingL7AnalysisDataRequest() (request *DescribeTimingL7AnalysisDataRequest) {
+	request = &DescribeTimingL7AnalysisDataRequest{
+		BaseRequest: &tchttp.BaseRequest{},
+	}
+	request.Init().WithApiInfo(teoService, teoAPIVersion, "DescribeTimingL7AnalysisData")
+	return
+}
+
+func NewDownloadL7LogsRequest() (request *DownloadL7LogsRequest) {
+	request = &DownloadL7LogsRequest{
+		BaseRequest: &tchttp.BaseRequest{},
+	}
+	request.Init().WithApiInfo(teoService, teoAPIVersion, "DownloadL7Logs")
+	return
+}
+
+func teoSend(ctx context.Context, client *common.Client, request tchttp.Request, response tchttp.Response) error {
+	if client.GetCredential() == nil {
+		return errors1.New(request.GetAction() + " require credential")
+	}
+	request.SetContext(ctx)
+	return client.Send(request, response)
+}
+
+// teoTargets 指定 domains 时按域名过滤, 否则按站点汇总, Domain 字段填站点 ID
+func teoTargets(req reqForTencentLog) (zoneIds []string, domains []string) {
+	return SplitDomains(req.ZoneIds), SplitDomains(req.Domains)
+}
+
+// GetTeoMetric 查询 EdgeOne 七层分钟级流量, 转为 CDNDataResult 后走 formatData, 与 /tencent/onTimeLog 返回相同结构
+func GetTeoMetric(ctx context.Context, req reqForTencentLog) interface{} {
+	client := newTeoClient(req)
+	limiter := tencentLimiter(req.SecretID)
+	zoneIds, domains := teoTargets(req)
+
+	targets := domains
+	if len(targets) == 0 {
+		targets = zoneIds
+	}
+	var (
+		dataResults []CDNDataResult
+		errs        = make(map[string]map[string]string)
+		failed      = 0
+	)
+	for _, target := range targets {
+		for _, area := range tencentConf.Dimensions {
+			var results []CDNDataResult
+			err := limiter.Wait(ctx)
+			if err == nil {
+				// 按站点汇总时每个站点单独查询, 否则返回的是所有站点的数据
+				domain, queryZones := "", []string{target}
+				if len(domains) > 0 {
+					domain, queryZones = target, zoneIds
+				}
+				results, err = queryTeoTiming(ctx, client, req, queryZones, domain, target, area)
+			}
+			if err != nil {
+				fmt.Printf("### tencent-teo ### [target: %s] [area: %s] 查询失败: %v\n", target, area, err)
+				if errs[target] == nil {
+					errs[target] = make(map[string]string)
+				}
+				errs[target][area] = err.Error()
+				failed++
+				continue
+			}
+			dataResults = append(dataResults, results...)
+		}
+	}
+
+	res := make(map[string]interface{})
+	if len(targets) > 0 && failed == len(targets)*len(tencentConf.Dimensions) {
+		res["code"] = 50001
+		res["status"] = "fail"
+		res["data"] = "查询 EdgeOne 数据失败"
+		res["errors"] = errs
+		return res
+	}
+	formattedData := formatData(dataResults, nil)
+	res["code"] = 200
+	res["status"] = "success"
+	if failed > 0 {
+		res["status"] = "partial"
+		res["errors"] = errs
+	}
+	res["data"] = formattedData
+	if req.Persist {
+		written, err := persistTencentData(tencentPersistSinks(), req.TenantId, formattedData)
+		res["persisted"] = written
+		if err != nil {
+			log.Printf("### tencent-teo ### 落库失败: %v\n", err)
+			res["persistError"] = err.Error()
+		}
+	}
+	return res
+}
+
+func queryTeoTiming(ctx context.Context, client *common.Client, param reqForTencentLog, zoneIds []string, domain, target, area string) ([]CDNDataResult, error) {
+	var metricNames []string
+	for name := range tencentConf.TeoMetrics {
+		metricNames = append(metricNames, name)
+	}
+	sort.Strings(metricNames)
+
+	req := NewDescribeTimingL7AnalysisDataRequest()
+	req.StartTime = common.StringPtr(time.Unix(param.StartTime, 0).UTC().Format(time.RFC3339))
+	req.EndTime = common.StringPtr(time.Unix(param.EndTime, 0).UTC().Format(time.RFC3339))
+	req.MetricNames = common.StringPtrs(metricNames)
+	req.ZoneIds = common.StringPtrs(zoneIds)
+	req.Interval = common.StringPtr("min")
+	req.Area = common.StringPtr(area)
+	if domain != "" {
+		req.Filters = []*teoQueryCondition{{
+			Key:      common.StringPtr("domain"),
+			Operator: common.StringPtr("equals"),
+			Value:    common.StringPtrs([]string{domain}),
+		}}
+	}
+	resp := &DescribeTimingL7AnalysisDataResponse{BaseResponse: &tchttp.BaseResponse{}}
+	if err := teoSend(ctx, client, req, resp); err != nil {
+		if sdkErr, ok := err.(*errors.TencentCloudSDKError); ok {
+			return nil, fmt.Errorf("API Error[%s]Msg[%s]Id[%s]", sdkErr.GetCode(), sdkErr.GetMessage(), sdkErr.GetRequestId())
+		}
+		return nil, err
+	}
+	if resp.Response == nil {
+		return nil, nil
+	}
+
+	// 每个站点 (TypeKey) 一条记录, 按指标和时间点相加, 否则 formatData 中后面的记录会覆盖前面的值
+	var results []CDNDataResult
+	metricPos := make(map[string]int)
+	timePos := make(map[string]map[int64]int)
+	for _, record := range resp.Response.Data {
+		for _, value := range record.TypeValue {
+			metric, ok := tencentConf.TeoMetrics[value.MetricName]
+			if !ok {
+				continue
+			}
+			pos, ok := metricPos[metric]
+			if !ok {
+				pos = len(results)
+				metricPos[metric] = pos
+				timePos[metric] = make(map[int64]int)
+				results = append(results, CDNDataResult{Domain: target, DataType: area, Metric: metric})
+			}
+			result := &results[pos]
+			for _, item := range value.Detail {
+				if i, ok := timePos[metric][item.Timestamp]; ok {
+					result.Values[i] += int64(item.Value)
+					continue
+				}
+				timePos[metric][item.Timestamp] = len(result.Values)
+				result.Timestamps = append(result.Timestamps, strconv.FormatInt(item.Timestamp, 10))
+				result.Unix = append(result.Unix, item.Timestamp)
+				result.Values = append(result.Values, int64(item.Value))
+			}
+		}
+	}
+	return results, nil
+}
+
+// GetTeoLog 按 Offset 翻页查询 EdgeOne 离线日志下载地址
+func GetTeoLog(ctx context.Context, req reqForTencentLog) interface{} {
+	client := newTeoClient(req)
+	limiter := tencentLimiter(req.SecretID)
+	zoneIds, domains := teoTargets(req)
+
+	var logs []teoL7OfflineLog
+	for {
+		if err := limiter.Wait(ctx); err != nil {
+			return teoLogFail(err)
+		}
+		request := NewDownloadL7LogsRequest()
+		request.StartTime = common.StringPtr(time.Unix(req.StartTime, 0).UTC().Format(time.RFC3339))
+		request.EndTime = common.StringPtr(time.Unix(req.EndTime, 0).UTC().Format(time.RFC3339))
+		request.ZoneIds = common.StringPtrs(zoneIds)
+		request.Domains = common.StringPtrs(domains)
+		request.Limit = common.Int64Ptr(tencentLogPageSize)
+		request.Offset = common.Int64Ptr(int64(len(logs)))
+		resp := &DownloadL7LogsResponse{BaseResponse: &tchttp.BaseResponse{}}
+		if err := teoSend(ctx, client, request, resp); err != nil {
+			return teoLogFail(err)
+		}
+		if resp.Response == nil || len(resp.Response.Data) == 0 {
+			break
+		}
+		logs = append(logs, resp.Response.Data...)
+		if int64(len(logs)) >= resp.Response.TotalCount {
+			break
+		}
+	}
+
+	// 与 /tencent/zipLog 一致, 按域名和区域分组
+	data := make(map[string]map[string][]teoL7OfflineLog)
+	for _, l := range logs {
+		if data[l.Domain] == nil {
+			data[l.Domain] = make(map[string][]teoL7OfflineLog)
+		}
+		data[l.Domain][l.Area] = append(data[l.Domain][l.Area], l)
+	}
+	return map[string]interface{}{
+		"code":   200,
+		"status": "success",
+		"data":   data,
+	}
+}
+
+func teoLogFail(err error) interface{} {
+	fmt.Printf("### tencent-teo ### 查询日志失败: %v\n", err)
+	return map[string]interface{}{
+		"code":   50001,
+		"status": "fail",
+		"data":   "查询日志失败",
+		"error":  err.Error(),
+	}
+}
+
+// HandleTencentTeoOnTimeLog POST /tencent/teo/onTimeLog, 参数同 /tencent/onTimeLog, 另需 zoneIds
+func HandleTencentTeoOnTimeLog(w http.ResponseWriter, r *http.Request) {
+	handleTeo(w, r, GetTeoMetric)
+}
+
+// HandleTencentTeoZipLog POST /tencent/teo/zipLog
+func HandleTencentTeoZipLog(w http.ResponseWriter, r *http.Request) {
+	handleTeo(w, r, GetTeoLog)
+}
+
+func handleTeo(w http.ResponseWriter, r *http.Request, fn func(context.Context, reqForTencentLog) interface{}) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅支持 POST 方法", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 32<<20)
+	defer r.Body.Close()
+	req := reqForTencentLog{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("无效的 JSON 数据: %s\n", err.Error())
+		http.Error(w, "无效的 JSON 数据", http.StatusBadRequest)
+		return
+	}
+	if req.ZoneIds == "" {
+		http.Error(w, "缺少必要参数: zoneIds", http.StatusBadRequest)
+		return
+	}
+	marshal, _ := json.Marshal(fn(r.Context(), req))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshal)
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeTeoTimingServer 模拟 DescribeTimingL7AnalysisData: 请求的每个站点返回一条记录 (TypeKey 为站点 ID),
+// 流量为 zoneFlux 中的值; 带 domain 过滤时只有 z1 有该域名的流量
+func fakeTeoTimingServer(t *testing.T, zoneFlux map[string]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ZoneIds []string
+			Filters []struct{ Key string }
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var records []string
+		for _, zone := range req.ZoneIds {
+			flux := zoneFlux[zone]
+			if len(req.Filters) > 0 && zone != "z1" {
+				flux = 0
+			}
+			records = append(records, fmt.Sprintf(`{"TypeKey":%q,"TypeValue":[{"MetricName":"l7Flow_outFlux","Sum":%d,"Detail":[{"Timestamp":1704067200,"Value":%d}]}]}`, zone, flux, flux))
+		}
+		fmt.Fprintf(w, `{"Response":{"Data":[%s],"TotalCount":%d,"RequestId":"r"}}`, strings.Join(records, ","), len(records))
+	}))
+}
+
+func TestGetTeoMetric(t *testing.T) {
+	srv := fakeTeoTimingServer(t, map[string]int{"z1": 100, "z2": 200})
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		domains  string
+		wantFlux map[string]int64 // target -> 境内流量
+	}{
+		{name: "按站点汇总时每个站点只返回自己的数据", wantFlux: map[string]int64{"z1": 100, "z2": 200}},
+		{name: "按域名查询时合并各站点的记录", domains: "a.com", wantFlux: map[string]int64{"a.com": 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := reqForTencentLog{SecretID: "teo-test", SecretKey: "k", ZoneIds: "z1,z2", Domains: tt.domains,
+				EndPoint: srv.URL, StartTime: 1704067200, EndTime: 1704067500}
+			res := GetTeoMetric(context.Background(), req).(map[string]interface{})
+			data, _ := res["data"].(map[string][]map[string]interface{})
+			if res["status"] != "success" || len(data) != len(tt.wantFlux) {
+				t.Fatalf("返回 %v", res)
+			}
+			for target, want := range tt.wantFlux {
+				var got interface{}
+				for _, record := range data[target] {
+					if record["region"] == "mainland_china" {
+						got = record["flux"]
+					}
+				}
+				if got != want {
+					t.Fatalf("%s 的流量为 %v, 期望 %d: %v", target, got, want, data[target])
+				}
+			}
+		})
+	}
+}
@@ -6,9 +6,10 @@ import (
 )
 
 const (
-	tdAgentURL    = "http://localhost:9881/cftest.log"
-	maxRetry      = 3
-	retryInterval = 2 * time.Second
+	tdAgentURL     = "http://localhost:9881/cftest.log"
+	tdAgentBaseURL = "http://localhost:9881/"
+	maxRetry       = 3
+	retryInterval  = 2 * time.Second
 )
 
 var (
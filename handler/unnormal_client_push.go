@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"bytes"
 	"cf_logpush/dto"
 	"compress/gzip"
-	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/olivere/elastic/v7"
@@ -20,9 +22,18 @@ const (
 	BillingData
 )
 
+// 客户端推送未带 interval 时按分钟粒度处理
+const clientPushInterval = 60
+
+// clientPushIntervals 允许的上报粒度 (秒)
+var clientPushIntervals = map[int64]bool{60: true, 300: true}
+
 var (
 	esClient *elastic.Client
 	esOnce   sync.Once
+
+	// ES 请求走共用的重试/熔断; 超时由各请求的 ctx 控制, reindex 等长请求不设整体超时
+	esTransport = newRetryHTTPClient("es", 0, defaultRetryPolicy, nil)
 )
 
 func init() {
@@ -51,12 +62,14 @@ func init() {
 				elastic.SetBasicAuth(username, password),
 				elastic.SetSniff(false),
 				elastic.SetHealthcheck(false),
+				elastic.SetHttpClient(&http.Client{Transport: esTransport}),
 			)
 		} else {
 			client, err = elastic.NewClient(
 				elastic.SetURL(esURL),
 				elastic.SetSniff(false),
 				elastic.SetHealthcheck(false),
+				elastic.SetHttpClient(&http.Client{Transport: esTransport}),
 			)
 		}
 		if err != nil {
@@ -67,6 +80,23 @@ func init() {
 }
 
 func HandleStatisticalData(w http.ResponseWriter, r *http.Request) {
+	handleClientPush(w, r, StatisticalData, "client_push_statistical_data")
+}
+
+func HandleBillingData(w http.ResponseWriter, r *http.Request) {
+	handleClientPush(w, r, BillingData, "client_push_billing_data")
+}
+
+// clientPushResult 批量推送时每条记录的处理结果, Index 为记录在请求中的下标
+type clientPushResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleClientPush 请求体可以是单个 JSON 对象、JSON 数组或 NDJSON;
+// 单个对象保持原有的响应格式, 数组和 NDJSON 按下标返回每条记录的结果
+func handleClientPush(w http.ResponseWriter, r *http.Request, t uint8, tag string) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "仅支持 POST 方法", http.StatusMethodNotAllowed)
 		return
@@ -93,95 +123,219 @@ func HandleStatisticalData(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "读取请求体时出错", http.StatusBadRequest)
 		return
 	}
-	outputLog := dto.OutputLog{}
-	err = json.Unmarshal(body, &outputLog)
+	records, batch, err := parseClientPushBody(body)
 	if err != nil {
 		log.Printf("无效的 JSON 数据: %s\n", err.Error())
 		http.Error(w, "无效的 JSON 数据, 请注意检察参数类型", http.StatusBadRequest)
 		return
 	}
-	if outputLog.TenantId == "" {
-		http.Error(w, "tenantId 不能为空", http.StatusBadRequest)
+	wait := esAckMode(r) == esAckSync
+
+	if !batch {
+		outputLog, interval, err := decodeClientPush(records[0], t)
+		if err != nil {
+			log.Printf("无效的 JSON 数据: %s\n", err.Error())
+			http.Error(w, "无效的 JSON 数据, 请注意检察参数类型", http.StatusBadRequest)
+			return
+		}
+		if err := validateClientPush(outputLog, interval, t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := submitToES(outputLog, t, interval, wait)
+		if err != nil {
+			log.Printf("### %s err ### [time: %s] [Err: %s]\n", tag, time.Now().Format(time.DateTime), err.Error())
+			http.Error(w, "服务出错", http.StatusInternalServerError)
+			return
+		}
+		marshal, _ := json.Marshal(outputLog)
+		fmt.Println("### " + tag + " ### [time: " + time.Now().Format(time.DateTime) + "] data:" + string(marshal))
+		writeESStatus(w, status)
 		return
 	}
-	if outputLog.StartTime == 0 {
-		http.Error(w, "start_time 不能为 0", http.StatusBadRequest)
-		return
+
+	// 批量记录先依次入队, 由 bulk 管道合并写入, 全部入队后再等待写入结果;
+	// 队列满时入队会阻塞, 按 ES 的写入速度减速, 不为每条记录起 goroutine
+	results := make([]clientPushResult, len(records))
+	pending := make(map[int]*esBulkItem)
+	for i, raw := range records {
+		results[i].Index = i
+		outputLog, interval, err := decodeClientPush(raw, t)
+		if err != nil {
+			results[i].Status, results[i].Error = "fail", "无效的 JSON 数据: "+err.Error()
+			continue
+		}
+		if err := validateClientPush(outputLog, interval, t); err != nil {
+			results[i].Status, results[i].Error = "fail", err.Error()
+			continue
+		}
+		item, status, err := beginToES(outputLog, t, interval, wait)
+		if err != nil {
+			results[i].Status, results[i].Error = "fail", err.Error()
+			continue
+		}
+		results[i].Status = status
+		if item != nil && wait {
+			pending[i] = item
+		}
 	}
-	err = sendToES(outputLog, StatisticalData)
-	if err != nil {
-		log.Printf("### client_push_statistical_data err ### [time: " + time.Now().Format(time.DateTime) + "] [Err: " + err.Error() + "]")
-		http.Error(w, "服务出错", http.StatusInternalServerError)
-		return
+	for i, item := range pending {
+		status, err := getESBulk().await(item)
+		if err != nil {
+			results[i].Status, results[i].Error = "fail", err.Error()
+			continue
+		}
+		results[i].Status = status
 	}
-	marshal, _ := json.Marshal(outputLog)
-	fmt.Println("### client_push_statistical_data ### [time: " + time.Now().Format(time.DateTime) + "] data:" + string(marshal))
-	w.Write([]byte("success"))
-	w.WriteHeader(http.StatusOK)
+
+	failed, conflicts := 0, 0
+	for _, res := range results {
+		switch res.Status {
+		case "fail":
+			failed++
+		case esStatusConflict:
+			conflicts++
+		}
+	}
+	fmt.Printf("### %s ### [time: %s] [records: %d] [failed: %d]\n", tag, time.Now().Format(time.DateTime), len(records), failed)
+	status := "success"
+	if failed == len(records) {
+		status = "fail"
+	} else if failed > 0 {
+		status = "partial"
+	}
+	marshal, _ := json.Marshal(map[string]interface{}{
+		"code":      http.StatusOK,
+		"status":    status,
+		"total":     len(records),
+		"failed":    failed,
+		"conflicts": conflicts,
+		"results":   results,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshal)
 }
 
-func HandleBillingData(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "仅支持 POST 方法", http.StatusMethodNotAllowed)
-		return
+// parseClientPushBody 拆分请求体, batch 为 false 表示单个 JSON 对象
+func parseClientPushBody(body []byte) ([]json.RawMessage, bool, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, false, fmt.Errorf("请求体为空")
+	}
+	if trimmed[0] == '[' {
+		var records []json.RawMessage
+		if err := json.Unmarshal(trimmed, &records); err != nil {
+			return nil, false, err
+		}
+		if len(records) == 0 {
+			return nil, false, fmt.Errorf("数组为空")
+		}
+		return records, true, nil
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 32<<20)
-	defer r.Body.Close()
+	// 多行格式化的单个对象也是合法 JSON, 优先按单条处理
+	if json.Valid(trimmed) {
+		return []json.RawMessage{trimmed}, false, nil
+	}
+	var records []json.RawMessage
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		records = append(records, json.RawMessage(line))
+	}
+	return records, true, nil
+}
 
-	var reader io.Reader = r.Body
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		gzipReader, err := gzip.NewReader(r.Body)
-		if err != nil {
-			log.Printf("创建 gzip 解压缩器时出错: %v\n", err)
-			http.Error(w, "无法解压缩请求体", http.StatusBadRequest)
-			return
+// decodeClientPush 按数据类型解析带 interval 的推送记录, 未带 interval 时按 clientPushInterval 处理
+func decodeClientPush(raw json.RawMessage, t uint8) (dto.OutputLog, int64, error) {
+	if t == StatisticalData {
+		var d dto.ClientOutPutStatisticalData
+		if err := json.Unmarshal(raw, &d); err != nil {
+			return d.OutputLog, 0, err
 		}
-		defer gzipReader.Close()
-		reader = gzipReader
+		if d.Interval == 0 {
+			d.Interval = clientPushInterval
+		}
+		return d.OutputLog, d.Interval, nil
 	}
+	var d dto.ClientOutPut
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return d.OutputLog, 0, err
+	}
+	if d.Interval == 0 {
+		d.Interval = clientPushInterval
+	}
+	return d.OutputLog, d.Interval, nil
+}
 
-	body, err := io.ReadAll(reader)
-	if err != nil {
-		log.Printf("读取请求体时出错: %v\n", err)
-		http.Error(w, "读取请求体时出错", http.StatusBadRequest)
-		return
+func validateClientPush(d dto.OutputLog, interval int64, t uint8) error {
+	if !clientPushIntervals[interval] {
+		return fmt.Errorf("interval 只支持 60 或 300 秒, 当前: %d", interval)
 	}
-	outputLog := dto.OutputLog{}
-	err = json.Unmarshal(body, &outputLog)
-	if err != nil {
-		log.Printf("无效的 JSON 数据: %s\n", err.Error())
-		http.Error(w, "无效的 JSON 数据, 请注意检察参数类型", http.StatusBadRequest)
-		return
+	if d.TenantId == "" {
+		return fmt.Errorf("tenantId 不能为空")
 	}
-	if outputLog.TenantId == "" {
-		http.Error(w, "tenantId 不能为空", http.StatusBadRequest)
-		return
+	if t == BillingData && d.Flux == 0 && d.BW == 0 {
+		return fmt.Errorf("flux 和 bw 不能同时为 0")
 	}
-	if outputLog.Flux == 0 && outputLog.BW == 0 {
-		http.Error(w, "flux 和 bw 不能同时为 0", http.StatusBadRequest)
-		return
+	if d.StartTime == 0 {
+		return fmt.Errorf("start_time 不能为 0")
 	}
-	if outputLog.StartTime == 0 {
-		http.Error(w, "start_time 不能为 0", http.StatusBadRequest)
-		return
+	return nil
+}
+
+func sendToES(d dto.OutputLog, t uint8) error {
+	return sendToESWithInterval(d, t, clientPushInterval)
+}
+
+// esDocID 由租户、域名、时间、粒度、国家和地区生成确定性的文档 ID, 重复推送同一条数据时覆盖而不是新增
+func esDocID(d dto.OutputLog, interval int64) string {
+	key := fmt.Sprintf("%s|%s|%d|%d|%s|%s", d.TenantId, d.Domain, d.StartTime, interval, d.Country, d.Region)
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendToESWithInterval interval 为数据粒度 (秒), 参与文档 ID 并写入 ES
+func sendToESWithInterval(d dto.OutputLog, t uint8, interval int64) error {
+	_, err := submitToES(d, t, interval, true)
+	return err
+}
+
+// submitToES 通过批量写入管道写 ES, wait 为 false 时入队即返回
+func submitToES(d dto.OutputLog, t uint8, interval int64, wait bool) (string, error) {
+	indexName, dataToIndex, err := esDocument(d, t, interval)
+	if err != nil {
+		return "", err
 	}
-	err = sendToES(outputLog, BillingData)
+	return getESBulk().submit(indexName, esDocID(d, interval), dataToIndex, wait)
+}
+
+// beginToES 同 submitToES 但只入队, wait 为 true 时由调用方 await 返回的 item
+func beginToES(d dto.OutputLog, t uint8, interval int64, wait bool) (*esBulkItem, string, error) {
+	indexName, dataToIndex, err := esDocument(d, t, interval)
 	if err != nil {
-		log.Printf("### client_push_billingData err ### [time: " + time.Now().Format(time.DateTime) + "] [Err: " + err.Error() + "]")
-		http.Error(w, "服务出错", http.StatusInternalServerError)
-		return
+		return nil, "", err
 	}
-	marshal, _ := json.Marshal(outputLog)
-	fmt.Println("### client_push_billing_data ### [time: " + time.Now().Format(time.DateTime) + "] data:" + string(marshal))
-	w.Write([]byte("success"))
-	w.WriteHeader(http.StatusOK)
+	return getESBulk().begin(indexName, esDocID(d, interval), dataToIndex, wait)
 }
 
-func sendToES(d dto.OutputLog, t uint8) error {
-	if esClient == nil {
-		return fmt.Errorf("ES 客户端未初始化")
+// normalizeBW 只上报了流量时, 用 flux(字节)*8/interval 得到该粒度内的平均带宽 (bps),
+// 使 1 分钟和 5 分钟粒度的 bw 都表示速率, 可以直接比较和相加
+func normalizeBW(d dto.OutputLog, interval int64) dto.OutputLog {
+	if d.BW == 0 && d.Flux > 0 {
+		d.BW = int(int64(d.Flux) * 8 / interval)
 	}
+	if d.BSBW == 0 && d.BSFlux > 0 {
+		d.BSBW = int(int64(d.BSFlux) * 8 / interval)
+	}
+	return d
+}
+
+// esDocument 返回数据所在的月索引和写入的文档
+func esDocument(d dto.OutputLog, t uint8, interval int64) (string, interface{}, error) {
+	d = normalizeBW(d, interval)
 	timestamp := time.Unix(0, d.StartTime*int64(time.Millisecond))
 	month := timestamp.Format("01")
 	year := timestamp.Format("2006")
@@ -212,8 +366,10 @@ func sendToES(d dto.OutputLog, t uint8) error {
 			BSHTTPCode3XX: d.BSHTTPCode3XX,
 			BSHTTPCode4XX: d.BSHTTPCode4XX,
 			BSHTTPCode5XX: d.BSHTTPCode5XX,
+			BSDurationMs:  d.BSDurationMs,
 			TenantId:      d.TenantId,
 			TimeLocal:     d.StartTime / 1000,
+			Interval:      interval,
 		}
 	} else if t == BillingData {
 		indexName = fmt.Sprintf("log_push_billing_data-%s.%s", year, month)
@@ -224,23 +380,26 @@ func sendToES(d dto.OutputLog, t uint8) error {
 			Domain:    d.Domain,
 			BW:        d.BW,
 			Flux:      d.Flux,
+			Interval:  interval,
 		}
 
 	} else {
-		return fmt.Errorf("未知的数据类型: %d", t)
+		return "", nil, fmt.Errorf("未知的数据类型: %d", t)
 	}
+	return indexName, dataToIndex, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err := esClient.Index().
-		Index(indexName).
-		BodyJson(dataToIndex).
-		Do(ctx)
-
-	if err != nil {
-		return fmt.Errorf("推送数据到 ES 失败: %w", err)
+// writeESStatus 同步确认写入成功时保持原有的 success 响应, 异步入队返回 accepted, 写入 spool 返回 spooled,
+// create 模式下文档已存在返回 duplicate
+func writeESStatus(w http.ResponseWriter, status string) {
+	switch status {
+	case esStatusQueued:
+		w.Write([]byte("accepted"))
+	case esStatusSpooled:
+		w.Write([]byte("spooled"))
+	case esStatusConflict:
+		w.Write([]byte("duplicate"))
+	default:
+		w.Write([]byte("success"))
 	}
-
-	return nil
 }
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+func TestClientPushLargeBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []string
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(make([]byte, 1<<20), 1<<20)
+		for i := 0; sc.Scan(); i++ {
+			if i%2 == 0 {
+				items = append(items, `{"index":{"_index":"x","status":201}}`)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	}))
+	defer srv.Close()
+	client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldClient, oldBulk := esClient, getESBulk()
+	esClient = client
+	esBulk = newESBulkIndexer(esBulkConfig{Workers: 2, Actions: 500, Bytes: 1 << 20, Interval: 10 * time.Millisecond,
+		QueueSize: 100, MaxAttempts: 1, SpoolDir: t.TempDir(), Replay: time.Hour, WriteMode: esWriteIndex, EnqueueWait: 5 * time.Second})
+	defer func() {
+		esBulk.shutdown(time.Second)
+		esClient, esBulk = oldClient, oldBulk
+	}()
+
+	const records = 5000
+	var body strings.Builder
+	for i := 0; i < records; i++ {
+		fmt.Fprintf(&body, `{"tenantId":"t","start_time":%d,"flux":1,"domain":"a.com"}`+"\n", 1704067200000+int64(i)*60000)
+	}
+	body.WriteString(`{"start_time":1}` + "\n")
+
+	// 采样处理期间的 goroutine 数, 不能随记录数增长
+	base := runtime.NumGoroutine()
+	var peak int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if n := int64(runtime.NumGoroutine()); n > atomic.LoadInt64(&peak) {
+				atomic.StoreInt64(&peak, n)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	w := httptest.NewRecorder()
+	HandleBillingData(w, httptest.NewRequest(http.MethodPost, "/?ack=sync", strings.NewReader(body.String())))
+	close(stop)
+	<-sampled
+
+	var res struct {
+		Status  string
+		Total   int
+		Failed  int
+		Results []clientPushResult
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if res.Status != "partial" || res.Total != records+1 || res.Failed != 1 || res.Results[0].Status != esStatusIndexed || res.Results[records].Error == "" {
+		t.Fatalf("返回 %+v", res)
+	}
+	if p := atomic.LoadInt64(&peak); p > int64(base)+50 {
+		t.Fatalf("处理 %d 条记录时 goroutine 峰值 %d, 基线 %d", records, p, base)
+	}
+}
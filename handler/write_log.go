@@ -4,8 +4,10 @@ import (
 	"cf_logpush/dto"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +25,9 @@ var (
 			return make([]byte, 0, 1024)
 		},
 	}
+
+	pendingLogs      sync.WaitGroup
+	logWriteBlocking atomic.Bool
 )
 
 type LogEntry struct {
@@ -110,17 +115,66 @@ func WriteToFile(l dto.InputLogForDownLoad) {
 		fmt.Println("Error creating directory: " + err.Error())
 		return
 	}
-	select {
-	case logChan <- &LogEntry{
+	enqueueLog(&LogEntry{
+		content:  line + "\n",
+		filename: filepath.Join(dto.LogPath, filePath, filename),
+		logTime:  t,
+	})
+}
+
+// WriteDatasetToFile 其他 Logpush 数据集按 LogPath/<dataset>/<日期>/<5分钟>-<key> 存放, 每行一条 JSON
+func WriteDatasetToFile(dataset, key string, t time.Time, line string) {
+	timeLoc, _ := time.LoadLocation("Asia/Shanghai")
+	t = t.In(timeLoc)
+	if key == "" {
+		key = dataset
+	}
+	key = strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(key)
+
+	fiveMinTime := t.Truncate(5 * time.Minute)
+	filename := fmt.Sprintf("%s-%s", fiveMinTime.Format("200601021504"), key)
+	filePath := dataset + "/" + fiveMinTime.Format("20060102")
+	if err := createDirIfNotExist(filePath); err != nil {
+		fmt.Println("Error creating directory: " + err.Error())
+		return
+	}
+	enqueueLog(&LogEntry{
 		content:  line + "\n",
-		filename: dto.LogPath + filePath + "/" + filename,
+		filename: filepath.Join(dto.LogPath, filePath, filename),
 		logTime:  t,
-	}:
+	})
+}
+
+// enqueueLog 默认队列满时丢弃, 回补等批量任务开启阻塞模式后等待写入
+func enqueueLog(entry *LogEntry) {
+	pendingLogs.Add(1)
+	if logWriteBlocking.Load() {
+		logChan <- entry
+		return
+	}
+	select {
+	case logChan <- entry:
 	default:
-		fmt.Printf("Warning: Log channel is full, dropping log entry for %s\n", filename)
+		pendingLogs.Done()
+		fmt.Printf("Warning: Log channel is full, dropping log entry for %s\n", entry.filename)
 	}
 }
 
+// SetLogWriteBlocking 批量任务开启后写离线日志不再丢弃
+func SetLogWriteBlocking(blocking bool) {
+	logWriteBlocking.Store(blocking)
+}
+
+// FlushLogs 等待队列中的离线日志全部写完并关闭文件句柄, 进程退出前调用
+func FlushLogs() {
+	pendingLogs.Wait()
+	fileHandles.Range(func(key, value interface{}) bool {
+		value.(*os.File).Close()
+		fileHandles.Delete(key)
+		return true
+	})
+}
+
 func getSubTime(s, e string) int64 {
 	layout := "2006-01-02T15:04:05Z"
 	t1, err := time.Parse(layout, s)
@@ -153,6 +207,7 @@ func processLogs() {
 		select {
 		case entry := <-logChan:
 			writeLogToFile(entry)
+			pendingLogs.Done()
 		case <-ticker.C:
 			cleanupOldFiles()
 		}
@@ -160,8 +215,9 @@ func processLogs() {
 }
 
 func createDirIfNotExist(filePath string) error {
-	if _, err := os.Stat(dto.LogPath + filePath); os.IsNotExist(err) {
-		if err := os.MkdirAll(dto.LogPath+filePath, os.ModePerm); err != nil {
+	dir := filepath.Join(dto.LogPath, filePath)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 			return err
 		}
 	}
@@ -3,19 +3,32 @@ package main
 import (
 	"cf_logpush/dto"
 	"cf_logpush/handler"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
 	//defaultLogPath = "/Users/*****/Desktop/"
 	defaultLogPath = "/var/log/hwcdn/cdnlogfiles/"
+
+	// 子命令, 例如: cf_logpush cf-backfill -zone xxx -start 1700000000 -end 1700003600
+	commands = map[string]func(args []string) error{
+		"cf-backfill":    handler.RunCloudFlareBackfill,
+		"tencent-replay": handler.RunTencentReplay,
+		"es-indices":     handler.RunESIndices,
+		"billing-report": handler.RunBillingReport,
+		"tencent-repair": handler.RunTencentRepair,
+	}
 )
 
 func init() {
-	if os.Args != nil && len(os.Args) > 1 {
+	if os.Args != nil && len(os.Args) > 1 && commands[os.Args[1]] == nil {
 		dto.LogPath = os.Args[1]
 	} else {
 		dto.LogPath = defaultLogPath
@@ -24,18 +37,64 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			err := cmd(os.Args[2:])
+			handler.StopESBulk(30 * time.Second)
+			if err != nil {
+				log.Fatalf("%s 执行失败: %v\n", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	http.HandleFunc("/", handler.HandleLogs)
+	http.HandleFunc("/logpush/", handler.HandleDatasetLogs)
 	http.HandleFunc("/tencent/onTimeLog", handler.HandleTencentOnTimeLog)
 	http.HandleFunc("/tencent/zipLog", handler.HandleTencentZipLog)
+	http.HandleFunc("/tencent/convertLog", handler.HandleTencentConvertLog)
+	http.HandleFunc("/tencent/teo/onTimeLog", handler.HandleTencentTeoOnTimeLog)
+	http.HandleFunc("/tencent/teo/zipLog", handler.HandleTencentTeoZipLog)
+	http.HandleFunc("/tencent/jobs", handler.HandleTencentJobs)
+	http.HandleFunc("/tencent/jobs/result", handler.HandleTencentJobResult)
+	http.HandleFunc("/tencent/debug/replay", handler.HandleTencentReplay)
 	http.HandleFunc("/cloudFlare/onTimeLog", handler.HandleCloudFlareOnTimeLog)
+	http.HandleFunc("/cloudFlare/reconcile", handler.HandleReconcile)
 	http.HandleFunc("/client/log_push", handler.HandleClientLogPush)
 
 	http.HandleFunc("/v2/client/log_push/statisticalData", handler.HandleStatisticalData)
 	http.HandleFunc("/v2/client/log_push/billingData", handler.HandleBillingData)
+	http.HandleFunc("/v2/query/timeseries", handler.HandleQueryTimeSeries)
+	http.HandleFunc("/v2/query/top", handler.HandleQueryTop)
+	http.HandleFunc("/v2/billing", handler.HandleBilling)
+	http.HandleFunc("/v2/billing/report", handler.HandleBillingReport)
+
+	handler.StartCloudFlarePoller()
+	handler.StartReconciler()
+	handler.StartS3Puller()
+	handler.StartTencentJobs()
+	handler.StartTencentPoller()
+	handler.StartESBootstrap()
+	handler.StartESBulk()
+	handler.StartReportScheduler()
 	port := "9880"
 	log.Printf("启动日志接收服务器，监听端口 %s...\n", port)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("无法启动服务器: %v\n", err)
-	}
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("无法启动服务器: %v\n", err)
+		}
+	}()
+
+	// 退出前停止接收请求, 把 ES 队列中未写入的数据写完或落到 spool, 并刷新离线日志
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Println("收到退出信号, 正在关闭...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	handler.StopESBulk(30 * time.Second)
+	handler.FlushLogs()
 }